@@ -1,10 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	md "github.com/JohannesKaufmann/html-to-markdown"
 	"github.com/JohannesKaufmann/html-to-markdown/plugin"
+	"github.com/PuerkitoBio/goquery"
 	"github.com/charmbracelet/glamour"
 	buildkite "github.com/kevinburke/buildkite/lib"
 	"golang.org/x/term"
@@ -18,11 +23,112 @@ func getTerminalWidth() int {
 	return width
 }
 
-func getANSIAnnotations(annotations buildkite.AnnotationResponse) ([]string, error) {
+// maxAnnotationWidth caps the width of rendered annotations on wide
+// terminals, since long lines of prose are hard to read.
+const maxAnnotationWidth = 120
+
+// annotationWidth returns the width to render annotations at on stdout.
+func annotationWidth() int {
 	width := getTerminalWidth()
-	if width > 120 {
-		width = 120
+	if width > maxAnnotationWidth {
+		width = maxAnnotationWidth
+	}
+	return width
+}
+
+// imageText replaces an image with its alt text, or its URL if it has none;
+// terminals can't display images.
+func imageText(content string, selec *goquery.Selection, opt *md.Options) *string {
+	alt := strings.TrimSpace(selec.AttrOr("alt", ""))
+	if alt == "" {
+		alt = strings.TrimSpace(selec.AttrOr("src", ""))
+	}
+	if alt == "" {
+		return md.String("")
 	}
+	return md.String("[image: " + alt + "]")
+}
+
+// cellText returns the text of each cell in a table row.
+func cellText(row *goquery.Selection) []string {
+	var cells []string
+	row.Find("th, td").Each(func(_ int, cell *goquery.Selection) {
+		cells = append(cells, strings.Join(strings.Fields(cell.Text()), " "))
+	})
+	return cells
+}
+
+// narrowTable returns a rule that renders tables too wide to fit in width
+// columns as a list, with one item per row, since wrapped table cells are
+// unreadable. Tables that fit are left to the table plugin.
+func narrowTable(width int) md.Rule {
+	return md.Rule{
+		Filter: []string{"table"},
+		Replacement: func(content string, selec *goquery.Selection, opt *md.Options) *string {
+			var rows [][]string
+			selec.Find("tr").Each(func(_ int, row *goquery.Selection) {
+				rows = append(rows, cellText(row))
+			})
+			if len(rows) == 0 {
+				return nil
+			}
+			var colWidths []int
+			for _, row := range rows {
+				for i, cell := range row {
+					if i >= len(colWidths) {
+						colWidths = append(colWidths, 0)
+					}
+					if n := utf8.RuneCountInString(cell); n > colWidths[i] {
+						colWidths[i] = n
+					}
+				}
+			}
+			// Each column is padded by a space on either side and separated
+			// by a "|".
+			total := 1
+			for _, w := range colWidths {
+				total += w + 3
+			}
+			if total <= width {
+				return nil
+			}
+			header := rows[0]
+			var b strings.Builder
+			b.WriteString("\n\n")
+			for _, row := range rows[1:] {
+				b.WriteString("- ")
+				for i, cell := range row {
+					if i > 0 {
+						b.WriteString("; ")
+					}
+					if i < len(header) && header[i] != "" {
+						b.WriteString(header[i] + ": ")
+					}
+					b.WriteString(cell)
+				}
+				b.WriteString("\n")
+			}
+			b.WriteString("\n")
+			return md.String(b.String())
+		},
+	}
+}
+
+// newAnnotationConverter returns a converter from annotation HTML to markdown
+// that will be displayed width columns wide.
+func newAnnotationConverter(width int) *md.Converter {
+	converter := md.NewConverter("", true, nil)
+	converter.Use(plugin.Table())
+	converter.AddRules(
+		md.Rule{Filter: []string{"img"}, Replacement: imageText},
+		narrowTable(width),
+	)
+	return converter
+}
+
+// getANSIAnnotations renders annotations for a terminal that is width
+// columns wide.
+func getANSIAnnotations(annotations buildkite.AnnotationResponse, width int) ([]string, error) {
 	renderer, err := glamour.NewTermRenderer(
 		glamour.WithAutoStyle(),
 		glamour.WithWordWrap(width),
@@ -31,8 +137,7 @@ func getANSIAnnotations(annotations buildkite.AnnotationResponse) ([]string, err
 		return nil, err
 	}
 	var messages []string
-	converter := md.NewConverter("", true, nil)
-	converter.Use(plugin.Table())
+	converter := newAnnotationConverter(width)
 	for _, annotation := range annotations {
 		content, err := converter.ConvertString(annotation.BodyHTML)
 		if err != nil {
@@ -46,3 +151,112 @@ func getANSIAnnotations(annotations buildkite.AnnotationResponse) ([]string, err
 	}
 	return messages, nil
 }
+
+// Formats for printing annotations, chosen with the -annotations flag.
+const (
+	annotationsANSI     = "ansi"
+	annotationsMarkdown = "markdown"
+	annotationsHTML     = "html"
+	annotationsNone     = "none"
+)
+
+// parseAnnotationFormat validates the -annotations flag. If format is empty,
+// it picks styled output for a terminal and plain markdown otherwise, so
+// redirected output doesn't fill up with escape codes.
+func parseAnnotationFormat(format string, tty bool) (string, error) {
+	switch format {
+	case "":
+		if tty {
+			return annotationsANSI, nil
+		}
+		return annotationsMarkdown, nil
+	case annotationsANSI, annotationsMarkdown, annotationsHTML, annotationsNone:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown annotation format %q, want one of ansi, markdown, html or none", format)
+	}
+}
+
+// passedBuildAnnotations returns the annotations to show for a build that
+// passed. Info annotations are usually noise once a build has passed, so they
+// are left out, unless includePassedAnnotations is set or the user asked for a
+// particular style.
+func passedBuildAnnotations(annotations buildkite.AnnotationResponse, opts waitOptions) buildkite.AnnotationResponse {
+	if opts.onlyFailedAnnotations {
+		return annotations.Failed()
+	}
+	if opts.includePassedAnnotations || opts.annotationStyle != "" {
+		return annotations
+	}
+	var shown buildkite.AnnotationResponse
+	for _, annotation := range annotations {
+		if annotation.Style != "info" {
+			shown = append(shown, annotation)
+		}
+	}
+	return shown
+}
+
+// failedBuildAnnotations returns the annotations to show for a build that
+// failed. These usually explain the failure, so every annotation is shown,
+// unless onlyFailedAnnotations is set.
+func failedBuildAnnotations(annotations buildkite.AnnotationResponse, opts waitOptions) buildkite.AnnotationResponse {
+	if opts.onlyFailedAnnotations {
+		return annotations.Failed()
+	}
+	return annotations
+}
+
+// orderAnnotations returns annotations sorted by creation time, then context,
+// with duplicate IDs removed, so output is the same from run to run. The
+// API's ordering isn't stable, and retries can return an annotation twice.
+func orderAnnotations(annotations buildkite.AnnotationResponse) buildkite.AnnotationResponse {
+	seen := make(map[string]bool, len(annotations))
+	ordered := make(buildkite.AnnotationResponse, 0, len(annotations))
+	for _, annotation := range annotations {
+		if annotation.ID != "" {
+			if seen[annotation.ID] {
+				continue
+			}
+			seen[annotation.ID] = true
+		}
+		ordered = append(ordered, annotation)
+	}
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if !ordered[i].CreatedAt.Equal(ordered[j].CreatedAt) {
+			return ordered[i].CreatedAt.Before(ordered[j].CreatedAt)
+		}
+		return ordered[i].Context < ordered[j].Context
+	})
+	return ordered
+}
+
+// renderAnnotations renders annotations in the given format, for output that
+// is width columns wide. Annotations are rendered in the order given by
+// orderAnnotations.
+func renderAnnotations(annotations buildkite.AnnotationResponse, format string, width int) ([]string, error) {
+	annotations = orderAnnotations(annotations)
+	switch format {
+	case annotationsANSI:
+		return getANSIAnnotations(annotations, width)
+	case annotationsMarkdown:
+		var messages []string
+		converter := newAnnotationConverter(width)
+		for _, annotation := range annotations {
+			content, err := converter.ConvertString(annotation.BodyHTML)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, content+"\n")
+		}
+		return messages, nil
+	case annotationsHTML:
+		var messages []string
+		for _, annotation := range annotations {
+			messages = append(messages, annotation.BodyHTML)
+		}
+		return messages, nil
+	default:
+		return nil, nil
+	}
+}
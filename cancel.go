@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// cancelableStates are the build states that cancel-all looks for.
+var cancelableStates = []string{"running", "scheduled"}
+
+func doCancelAll(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string) error {
+	pipelineService := client.Organization(org.Name).Pipeline(pipeline)
+	listCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	builds, err := pipelineService.ListBuilds(listCtx, url.Values{
+		"per_page": []string{"100"},
+		"branch":   []string{branch},
+		"state[]":  cancelableStates,
+	})
+	cancel()
+	if err != nil {
+		return err
+	}
+	if len(builds) == 0 {
+		fmt.Printf("No running or scheduled builds on %s\n", branch)
+		return nil
+	}
+	// Keep going if one build fails to cancel, so one bad build doesn't leave
+	// the rest running.
+	var failed []string
+	for _, build := range builds {
+		cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		_, err := pipelineService.Build(build.Number).Cancel(cancelCtx)
+		cancel()
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("\tbuild %d: %v", build.Number, err))
+			continue
+		}
+		fmt.Printf("Canceled build %d (%s)\n", build.Number, newFormattedBuild(build).ShortCommit())
+	}
+	fmt.Printf("Canceled %d of %d running or scheduled builds on %s\n", len(builds)-len(failed), len(builds), branch)
+	if len(failed) > 0 {
+		return fmt.Errorf("could not cancel %d builds:\n%s", len(failed), strings.Join(failed, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+	git "github.com/kevinburke/go-git"
+)
+
+// keyValueFlag collects repeated KEY=VALUE flags, e.g. -env FOO=bar.
+type keyValueFlag struct {
+	keys   []string
+	values map[string]string
+}
+
+func (f *keyValueFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	pairs := make([]string, len(f.keys))
+	for i, k := range f.keys {
+		pairs[i] = k + "=" + f.values[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f *keyValueFlag) Set(val string) error {
+	k, v, ok := strings.Cut(val, "=")
+	if !ok || strings.TrimSpace(k) == "" {
+		return fmt.Errorf("%q is not of the form KEY=VALUE", val)
+	}
+	if f.values == nil {
+		f.values = make(map[string]string)
+	}
+	if _, ok := f.values[k]; !ok {
+		f.keys = append(f.keys, k)
+	}
+	f.values[k] = v
+	return nil
+}
+
+// createOptions configures the build started by doCreate.
+type createOptions struct {
+	// The commit to build. If empty, the tip of the branch in the local
+	// repository, or "HEAD" if the branch doesn't exist locally.
+	commit string
+	// Environment variables to set for the build.
+	env keyValueFlag
+	// Meta-data to set on the build.
+	meta keyValueFlag
+	// The build message. If empty, the subject of the commit.
+	message string
+	// The author to show for the build, as "Name <email>" or just a name.
+	// If empty, the user.name and user.email from git config.
+	author string
+	// Print the new build as JSON, instead of a message for humans.
+	json bool
+}
+
+// parseAuthor splits an -author value like "Jane Doe <jane@example.com>" into
+// a name and email. A value without an email is treated as a name.
+func parseAuthor(author string) (name string, email string, err error) {
+	author = strings.TrimSpace(author)
+	if !strings.ContainsAny(author, "<@") {
+		return author, "", nil
+	}
+	addr, err := mail.ParseAddress(author)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid -author %q: use \"Name <email>\"", author)
+	}
+	return addr.Name, addr.Address, nil
+}
+
+// gitOutput runs git with args and returns its trimmed output, or the empty
+// string if the command fails.
+func gitOutput(args ...string) string {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// createBuildData returns the form values for a new build of commit on
+// branch. The author and message are only sent if set.
+func createBuildData(branch, commit string, opts createOptions, authorName, authorEmail string) url.Values {
+	data := url.Values{
+		"commit": []string{commit},
+		"branch": []string{branch},
+	}
+	if opts.message != "" {
+		data.Set("message", opts.message)
+	}
+	if authorName != "" {
+		data.Set("author[name]", authorName)
+	}
+	if authorEmail != "" {
+		data.Set("author[email]", authorEmail)
+	}
+	for _, k := range opts.env.keys {
+		data.Set("env["+k+"]", opts.env.values[k])
+	}
+	for _, k := range opts.meta.keys {
+		data.Set("meta_data["+k+"]", opts.meta.values[k])
+	}
+	return data
+}
+
+func doCreate(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, opts createOptions) error {
+	commit := opts.commit
+	if commit == "" {
+		tip, err := git.Tip(branch)
+		if err != nil {
+			// Buildkite resolves "HEAD" to the tip of the branch.
+			tip = "HEAD"
+		}
+		commit = tip
+	}
+	var authorName, authorEmail string
+	if opts.author != "" {
+		var err error
+		authorName, authorEmail, err = parseAuthor(opts.author)
+		if err != nil {
+			return err
+		}
+	} else {
+		authorName = gitOutput("config", "user.name")
+		authorEmail = gitOutput("config", "user.email")
+	}
+	if opts.message == "" && commit != "HEAD" {
+		opts.message = gitOutput("log", "-1", "--format=%s", commit)
+	}
+	return createBuild(ctx, client, org, pipeline, branch, commit, opts, authorName, authorEmail)
+}
+
+// doTrigger starts a build of commit (or the tip of branch, if commit is
+// empty) like doCreate, but takes everything from flags instead of the local
+// git repository, so it works outside a checkout.
+func doTrigger(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, opts createOptions) error {
+	commit := opts.commit
+	if commit == "" {
+		commit = "HEAD"
+	}
+	var authorName, authorEmail string
+	if opts.author != "" {
+		var err error
+		authorName, authorEmail, err = parseAuthor(opts.author)
+		if err != nil {
+			return err
+		}
+	}
+	return createBuild(ctx, client, org, pipeline, branch, commit, opts, authorName, authorEmail)
+}
+
+// createBuild starts the build and prints its number and URL, or the build as
+// JSON with opts.json.
+func createBuild(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline, branch, commit string, opts createOptions, authorName, authorEmail string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	data := createBuildData(branch, commit, opts, authorName, authorEmail)
+	build, err := client.Organization(org.Name).Pipeline(pipeline).CreateBuild(ctx, data)
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return writeBuildResult(os.Stdout, build)
+	}
+	fmt.Printf("Created build %d on %s\n", build.Number, branch)
+	fmt.Println(build.WebURL)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// chooseLogJob returns the job in build matching jobName, or if jobName is
+// empty, the first job that failed.
+func chooseLogJob(build buildkite.Build, jobName string) (buildkite.Job, error) {
+	if jobName != "" {
+		return findJob(build, jobName)
+	}
+	failed := build.FailedJobs()
+	if len(failed) == 0 {
+		return buildkite.Job{}, fmt.Errorf("no failed jobs in build %d, use -job to pick a job", build.Number)
+	}
+	return failed[0], nil
+}
+
+// defaultLogPath returns the file name download-log writes to when -o isn't
+// passed.
+func defaultLogPath(pipeline string, build buildkite.Build, job buildkite.Job) string {
+	return fmt.Sprintf("%s-%d-%s.log", pipeline, build.Number, job.ID)
+}
+
+func doDownloadLog(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, jobName string, path string) error {
+	latestBuild, err := getLatestBuild(ctx, client, org.Name, pipeline, branch)
+	if err != nil {
+		if err == buildkite.ErrNoBuilds {
+			//lint:ignore ST1005 this shows up in public facing error.
+			return fmt.Errorf("No results, are you sure there are tests for %s/%s?\n",
+				org.Name, pipeline)
+		}
+		return err
+	}
+	build, err := getBuild(ctx, client, org.Name, pipeline, latestBuild.Number)
+	if err != nil {
+		return err
+	}
+	job, err := chooseLogJob(build, jobName)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		path = defaultLogPath(pipeline, build, job)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// Logs can be large, so unlike other commands, don't time out the
+	// download.
+	err = client.Organization(org.Name).Pipeline(pipeline).Build(build.Number).Job(job.ID).StreamRawLog(ctx, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	fmt.Printf("Wrote log for %q in build %d to %s\n", job.Name, build.Number, path)
+	return nil
+}
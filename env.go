@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// secretKeyWords are substrings of environment variable names whose values
+// are hidden unless -show-secrets is passed.
+var secretKeyWords = []string{"TOKEN", "SECRET", "PASSWORD"}
+
+const redacted = "[redacted]"
+
+// isSecretKey reports whether the environment variable key likely holds a
+// secret.
+func isSecretKey(key string) bool {
+	upper := strings.ToUpper(key)
+	for _, word := range secretKeyWords {
+		if strings.Contains(upper, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatEnv returns env as sorted KEY=value lines. Unless showSecrets is
+// true, the values of keys that look like secrets are replaced.
+func formatEnv(env map[string]string, showSecrets bool) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		val := env[k]
+		if !showSecrets && isSecretKey(k) {
+			val = redacted
+		}
+		lines[i] = k + "=" + val
+	}
+	return lines
+}
+
+func doEnv(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, jobName string, showSecrets bool) error {
+	latestBuild, err := getLatestBuild(ctx, client, org.Name, pipeline, branch)
+	if err != nil {
+		if err == buildkite.ErrNoBuilds {
+			//lint:ignore ST1005 this shows up in public facing error.
+			return fmt.Errorf("No results, are you sure there are tests for %s/%s?\n",
+				org.Name, pipeline)
+		}
+		return err
+	}
+	build, err := getBuild(ctx, client, org.Name, pipeline, latestBuild.Number)
+	if err != nil {
+		return err
+	}
+	job, err := findJob(build, jobName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	env, err := client.Organization(org.Name).Pipeline(pipeline).Build(build.Number).Job(job.ID).Env(ctx)
+	if err != nil {
+		return err
+	}
+	for _, line := range formatEnv(env, showSecrets) {
+		fmt.Println(line)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// formattedBuild is the value passed to -format templates. It has every field
+// of buildkite.Build, plus some helpers for common formatting.
+type formattedBuild struct {
+	buildkite.Build
+	// These shadow the Build's pointer fields, which are nil for many builds
+	// (e.g. scheduled or API builds), so that {{.Creator.Name}} prints
+	// nothing for those instead of failing halfway through the output.
+	Creator     buildkite.User
+	PullRequest buildkite.PullRequest
+}
+
+func newFormattedBuild(build buildkite.Build) formattedBuild {
+	b := formattedBuild{Build: build}
+	if build.Creator != nil {
+		b.Creator = *build.Creator
+	}
+	if build.PullRequest != nil {
+		b.PullRequest = *build.PullRequest
+	}
+	return b
+}
+
+// ShortCommit returns the first 8 characters of the commit SHA.
+func (b formattedBuild) ShortCommit() string {
+	if len(b.Commit) > 8 {
+		return b.Commit[:8]
+	}
+	return b.Commit
+}
+
+// Title returns the first line of the commit message.
+func (b formattedBuild) Title() string {
+	return firstLine(b.Message)
+}
+
+// Created returns the time the build was created, in the local time zone.
+func (b formattedBuild) Created() string {
+	return b.CreatedAt.Local().Format("Jan 2 15:04")
+}
+
+// Elapsed returns how long the build ran, rounded to the second, or "-" if it
+// hasn't started.
+func (b formattedBuild) Elapsed() string {
+	if b.StartedAt.IsZero() {
+		return "-"
+	}
+	return b.Duration().Round(time.Second).String()
+}
+
+// buildResult is the machine-readable summary of a build, printed by commands
+// with a -json flag.
+type buildResult struct {
+	Number int64                `json:"number"`
+	WebURL string               `json:"web_url"`
+	State  buildkite.BuildState `json:"state"`
+	Branch string               `json:"branch"`
+	Commit string               `json:"commit"`
+}
+
+func newBuildResult(build buildkite.Build) buildResult {
+	return buildResult{
+		Number: build.Number,
+		WebURL: build.WebURL,
+		State:  build.State,
+		Branch: build.Branch,
+		Commit: build.Commit,
+	}
+}
+
+// writeBuildResult prints build to w as a single line of JSON.
+func writeBuildResult(w io.Writer, build buildkite.Build) error {
+	return json.NewEncoder(w).Encode(newBuildResult(build))
+}
+
+// buildFormats are the named presets for the -format flag. Presets are
+// aligned into columns on tabs; custom templates are printed as is.
+var buildFormats = map[string]string{
+	"short": "{{.Number}}\t{{.State}}\t{{.ShortCommit}}\t{{.Created}}\t{{.Title}}",
+	"wide":  "{{.Number}}\t{{.State}}\t{{.Commit}}\t{{.Created}}\t{{.Elapsed}}\t{{.Title}}\t{{.WebURL}}",
+}
+
+// buildFormatter prints a list of builds in the format chosen with -format.
+type buildFormatter struct {
+	tmpl *template.Template
+	// Whether to align output into columns.
+	table bool
+	// Whether to print the builds as a JSON array instead of using tmpl.
+	json bool
+}
+
+// parseBuildFormat parses the -format flag, which is either the name of a
+// preset ("short", "wide" or "json") or a text/template, e.g.
+// '{{.Number}} {{.State}}'. Templates that refer to fields that don't exist
+// are rejected here, instead of after the builds have been fetched.
+func parseBuildFormat(format string) (*buildFormatter, error) {
+	if format == "json" {
+		return &buildFormatter{json: true}, nil
+	}
+	f := new(buildFormatter)
+	if preset, ok := buildFormats[format]; ok {
+		format = preset
+		f.table = true
+	}
+	tmpl, err := template.New("format").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -format template: %w", err)
+	}
+	if err := tmpl.Execute(io.Discard, newFormattedBuild(buildkite.Build{})); err != nil {
+		return nil, fmt.Errorf("invalid -format template: %w", err)
+	}
+	f.tmpl = tmpl
+	return f, nil
+}
+
+// Write prints builds to w, one per line.
+func (f *buildFormatter) Write(w io.Writer, builds []buildkite.Build) error {
+	if f.json {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(builds)
+	}
+	var tw *tabwriter.Writer
+	if f.table {
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		w = tw
+	}
+	for _, build := range builds {
+		if err := f.tmpl.Execute(w, newFormattedBuild(build)); err != nil {
+			return err
+		}
+		io.WriteString(w, "\n")
+	}
+	if tw != nil {
+		return tw.Flush()
+	}
+	return nil
+}
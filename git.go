@@ -1,13 +1,231 @@
 package main
 
-import git "github.com/kevinburke/go-git"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+	git "github.com/kevinburke/go-git"
+)
 
 // Given a set of command line args, return the git branch or an error. Returns
 // the current git branch if no argument is specified
 func getBranchFromArgs(args []string) (string, error) {
 	if len(args) == 0 {
-		return git.CurrentBranch()
+		return currentBranch()
 	} else {
 		return args[0], nil
 	}
 }
+
+// getBranchForOrg is like getBranchFromArgs, but if there's no current branch
+// to use, it falls back to the org's configured default branch, if it has one.
+func getBranchForOrg(args []string, org buildkite.Organization) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	return currentBranchOr(org.DefaultBranch)
+}
+
+// branchEnvVars are environment variables that CI systems set to the branch
+// being built, checked in order when HEAD is detached.
+var branchEnvVars = []string{"BUILDKITE_BRANCH", "GIT_BRANCH"}
+
+// branchFromEnv returns the branch named by the first of branchEnvVars that is
+// set, or the empty string if none are. Jenkins sets GIT_BRANCH to e.g.
+// "origin/main", so a leading remote name is removed, if it's "origin" or one
+// of remotes.
+func branchFromEnv(getenv func(string) string, remotes []string) string {
+	for _, name := range branchEnvVars {
+		branch := strings.TrimSpace(getenv(name))
+		if branch == "" {
+			continue
+		}
+		branch = strings.TrimPrefix(branch, "refs/heads/")
+		for _, remote := range append([]string{"origin"}, remotes...) {
+			if trimmed := strings.TrimPrefix(branch, remote+"/"); trimmed != branch {
+				return trimmed
+			}
+		}
+		return branch
+	}
+	return ""
+}
+
+// errNoBranch is returned when HEAD is detached and there's no other way to
+// tell which branch it's on.
+var errNoBranch = errors.New("could not determine the current git branch; pass a branch name as an argument")
+
+// currentBranch returns the current git branch. CI systems often check out a
+// commit with a detached HEAD, so if there's no current branch, this falls
+// back to the branch named in the environment, then the only local branch
+// pointing at HEAD. If none of those work, it returns errNoBranch; a commit
+// SHA is never returned, since Buildkite has no builds on a branch named that.
+func currentBranch() (string, error) {
+	return currentBranchOr("")
+}
+
+// currentBranchOr is like currentBranch, but returns fallback instead of
+// errNoBranch if it's not empty.
+func currentBranchOr(fallback string) (string, error) {
+	branch, err := git.CurrentBranch()
+	if err == nil {
+		return branch, nil
+	}
+	remotes, _ := listRemotes()
+	if branch := branchFromEnv(os.Getenv, remotes); branch != "" {
+		return branch, nil
+	}
+	out, pointsErr := exec.Command("git", "branch", "--points-at", "HEAD", "--format=%(refname:short)").Output()
+	if pointsErr == nil {
+		if branches := strings.Fields(string(out)); len(branches) == 1 {
+			return branches[0], nil
+		}
+	}
+	if fallback != "" {
+		return fallback, nil
+	}
+	return "", errNoBranch
+}
+
+// listRemotes returns the names of all of the remotes configured in the
+// current git repository, e.g. "origin" and "upstream".
+func listRemotes() ([]string, error) {
+	result, err := exec.Command("git", "remote").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(result)), nil
+}
+
+// resolveRemote finds the Buildkite organization for the git remote named
+// remoteName. If that remote doesn't exist or doesn't map to an organization
+// in the config, every other remote in the repository is tried in turn - this
+// helps when "origin" is a fork and "upstream" is the repo that Buildkite
+// builds.
+func resolveRemote(cfg *buildkite.FileConfig, remoteName string) (*git.RemoteURL, buildkite.Organization, error) {
+	remote, remoteErr := git.GetRemoteURL(remoteName)
+	if remoteErr == nil {
+		if org, ok := cfg.OrgForRemote(remote.Path); ok {
+			return remote, org, nil
+		}
+	}
+	names, err := listRemotes()
+	if err == nil {
+		for _, name := range names {
+			if name == remoteName {
+				continue
+			}
+			rm, err := git.GetRemoteURL(name)
+			if err != nil {
+				continue
+			}
+			if org, ok := cfg.OrgForRemote(rm.Path); ok {
+				fmt.Fprintf(os.Stderr, "No Buildkite org for remote %q, using remote %q (%s) instead\n", remoteName, name, rm.Path)
+				return rm, org, nil
+			}
+		}
+	}
+	if remoteErr != nil {
+		return nil, buildkite.Organization{}, remoteErr
+	}
+	return nil, buildkite.Organization{}, fmt.Errorf("could not find a Buildkite org for remote %q", remote.Path)
+}
+
+// repoRoot returns the top level directory of the git checkout containing
+// path, or of the current directory if path is empty. path may be a file or a
+// subdirectory. In a linked worktree (see "git worktree"), this is the root of
+// the worktree, not of the main checkout; see mainWorktreeRoot.
+func repoRoot(path string) (string, error) {
+	return gitDirPath(path, "--show-toplevel")
+}
+
+// mainWorktreeRoot returns the root of the main checkout of the repository
+// containing path, or of the current directory if path is empty. Outside of a
+// linked worktree, this is the same as repoRoot.
+func mainWorktreeRoot(path string) (string, error) {
+	// Every worktree shares the main checkout's .git directory.
+	common, err := gitDirPath(path, "--git-common-dir")
+	if err != nil {
+		return "", err
+	}
+	if filepath.Base(common) != ".git" {
+		// A bare repository has no main checkout.
+		return "", fmt.Errorf("git: no main worktree for %s", common)
+	}
+	return filepath.Dir(common), nil
+}
+
+// gitDirPath runs "git rev-parse <flag>" in the directory containing path,
+// and returns the absolute path it prints.
+func gitDirPath(path, flag string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--path-format=absolute", flag)
+	if path != "" {
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+			path = filepath.Dir(path)
+		}
+		cmd.Dir = path
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git rev-parse %s: %v (%s)", flag, err, strings.TrimSpace(string(out)))
+	}
+	return filepath.Clean(strings.TrimSpace(string(out))), nil
+}
+
+// commitOnRemote reports whether commit is on any remote-tracking branch.
+// This uses the local copy of the remote branches, so it works offline but
+// may be out of date. ok is false if it couldn't be determined, for example
+// because the repository has no remotes.
+func commitOnRemote(commit string) (onRemote bool, ok bool) {
+	out, err := exec.Command("git", "branch", "-r", "--contains", commit).Output()
+	if err != nil {
+		return false, false
+	}
+	return strings.TrimSpace(string(out)) != "", true
+}
+
+// warnIfUnpushed prints a warning if commit hasn't been pushed, since
+// Buildkite will never build it. It returns true if it printed a warning.
+func warnIfUnpushed(commit string) bool {
+	onRemote, ok := commitOnRemote(commit)
+	if !ok || onRemote {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "Warning: commit %s is not on any remote branch, so Buildkite can't build it. Did you forget to push?\n", commit)
+	return true
+}
+
+// orgDefaultBranch returns the org's configured default branch, or if it
+// doesn't have one, the default branch according to the remote named
+// remoteName.
+func orgDefaultBranch(org buildkite.Organization, remoteName string) (string, error) {
+	if org.DefaultBranch != "" {
+		return org.DefaultBranch, nil
+	}
+	return defaultBranch(remoteName)
+}
+
+// defaultBranch returns the default branch of the repository, e.g. "main",
+// according to the remote named remoteName. If the remote's HEAD isn't known
+// locally, it looks for a "main" or "master" branch instead.
+func defaultBranch(remoteName string) (string, error) {
+	prefix := "refs/remotes/" + remoteName + "/"
+	if out, err := exec.Command("git", "symbolic-ref", "--quiet", prefix+"HEAD").Output(); err == nil {
+		if ref := strings.TrimSpace(string(out)); strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix), nil
+		}
+	}
+	for _, name := range []string{"main", "master"} {
+		for _, ref := range []string{prefix + name, "refs/heads/" + name} {
+			if exec.Command("git", "show-ref", "--verify", "--quiet", ref).Run() == nil {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("could not find the default branch for remote %q; try \"git remote set-head %s --auto\"", remoteName, remoteName)
+}
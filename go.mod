@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/BurntSushi/toml v1.3.2
 	github.com/JohannesKaufmann/html-to-markdown v1.6.0
+	github.com/PuerkitoBio/goquery v1.9.2
 	github.com/charmbracelet/glamour v0.7.0
 	github.com/kevinburke/bigtext v0.0.0-20220519224329-c26d116ded71
 	github.com/kevinburke/go-git v0.0.0-20220520045906-9c1360549bac
@@ -15,7 +16,6 @@ require (
 )
 
 require (
-	github.com/PuerkitoBio/goquery v1.9.2 // indirect
 	github.com/alecthomas/chroma/v2 v2.8.0 // indirect
 	github.com/andybalholm/cascadia v1.3.2 // indirect
 	github.com/andybrewer/mack v0.0.0-20220307193339-22e922cc18af // indirect
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+	"golang.org/x/term"
+)
+
+func isatty() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// stateColors maps a job state to a 256-color terminal code.
+var stateColors = map[buildkite.JobState]string{
+	"passed":    "34",
+	"failed":    "160",
+	"broken":    "160",
+	"timed_out": "160",
+	"canceled":  "244",
+	"skipped":   "244",
+	"running":   "178",
+	"scheduled": "178",
+	"assigned":  "178",
+	"accepted":  "178",
+}
+
+// jobReason returns a short explanation for a job that did not pass, or the
+// empty string if there is nothing interesting to say.
+func jobReason(job buildkite.Job) string {
+	if job.State == "finished" && job.Failed() {
+		return fmt.Sprintf("command exited with status %d", *job.ExitStatus)
+	}
+	switch job.State {
+	case "passed", "running":
+		return ""
+	case "failed":
+		if job.ExitStatus != nil {
+			return fmt.Sprintf("command exited with status %d", *job.ExitStatus)
+		}
+		return "command exited with an error"
+	case "broken":
+		return "did not run because a dependency failed"
+	case "timed_out":
+		return "exceeded the step timeout"
+	case "canceled", "canceling":
+		return "canceled before it finished"
+	case "skipped":
+		return "skipped by the pipeline"
+	case "blocked":
+		return "waiting to be unblocked"
+	case "expired":
+		return "no agent picked up the job in time"
+	case "scheduled", "assigned", "accepted", "pending", "waiting", "limited", "limiting":
+		return "waiting for an agent"
+	default:
+		return ""
+	}
+}
+
+func doJobs(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, onlyFailed bool, state string) error {
+	latestBuild, err := getLatestBuild(ctx, client, org.Name, pipeline, branch)
+	if err != nil {
+		if err == buildkite.ErrNoBuilds {
+			//lint:ignore ST1005 this shows up in public facing error.
+			return fmt.Errorf("No results, are you sure there are tests for %s/%s?\n",
+				org.Name, pipeline)
+		}
+		return err
+	}
+	build, err := getBuild(ctx, client, org.Name, pipeline, latestBuild.Number)
+	if err != nil {
+		return err
+	}
+	color := isatty()
+	fmt.Printf("Build %d on %s (%s)\n\n", build.Number, branch, build.State)
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, job := range build.Jobs {
+		// "waiter" jobs are the dividers between pipeline steps and don't
+		// have a name or a duration.
+		if job.Type == "waiter" {
+			continue
+		}
+		if onlyFailed && !job.Failed() {
+			continue
+		}
+		if state != "" && string(job.State) != state {
+			continue
+		}
+		stateString := fmt.Sprintf("%-10s", job.State)
+		if code, ok := stateColors[job.State]; ok && color {
+			stateString = "\033[38;05;" + code + "m" + stateString + "\033[0m"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s %s\n", job.Name, job.Duration().Round(time.Second).String(), stateString, jobReason(job))
+	}
+	return writer.Flush()
+}
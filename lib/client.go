@@ -2,13 +2,18 @@ package lib
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -22,17 +27,214 @@ const userAgent = "buildkite-go/" + Version
 const APIVersion = "v2"
 
 func NewClient(token string) *Client {
+	return NewClientWithHTTPClient(token, nil)
+}
+
+// NewClientWithHTTPClient is like NewClient, but makes requests using hc, so
+// callers can provide their own transport, timeout, or a client pointed at a
+// test server. If hc is nil, a default client is used.
+func NewClientWithHTTPClient(token string, hc *http.Client) *Client {
 	host := getHost()
 	if host == "" {
 		host = Host
 	}
 	rc := restclient.NewBearerClient(token, host)
+	rc.ErrorParser = parseError
+	// MakeRequest encodes request bodies as form values.
+	rc.UploadType = restclient.FormURLEncoded
+	if hc != nil {
+		rc.Client = hc
+	}
 	return &Client{Client: rc}
 }
 
+// NewProxyHTTPClient returns an HTTP client that sends every request through
+// the proxy at proxyURL, for use with NewClientWithHTTPClient. Clients created
+// by NewClient already honor the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables.
+func NewProxyHTTPClient(proxyURL string) (*http.Client, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", proxyURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+	return &http.Client{Transport: &restclient.Transport{
+		RoundTripper: transport,
+		Debug:        restclient.DefaultTransport.Debug,
+		Output:       restclient.DefaultTransport.Output,
+	}}, nil
+}
+
+// validationErrors returns the messages in the "errors" field of a 422 response
+// body. Buildkite sends either strings, or objects naming the invalid field.
+func validationErrors(raw []json.RawMessage) []string {
+	var msgs []string
+	for _, r := range raw {
+		var msg string
+		if err := json.Unmarshal(r, &msg); err == nil {
+			msgs = append(msgs, msg)
+			continue
+		}
+		var field struct {
+			Field   string `json:"field"`
+			Message string `json:"message"`
+			Code    string `json:"code"`
+		}
+		if err := json.Unmarshal(r, &field); err != nil {
+			continue
+		}
+		msg = field.Message
+		if msg == "" {
+			msg = field.Code
+		}
+		if field.Field != "" {
+			msg = field.Field + " " + msg
+		}
+		msgs = append(msgs, strings.TrimSpace(msg))
+	}
+	return msgs
+}
+
+// parseError converts an error response from the Buildkite API, which has a
+// body like {"message": "No pipeline found"}, into a *resterror.Error with the
+// HTTP status code set, so callers can check for e.g. a 404. For validation
+// errors, which list the invalid fields in "errors", Detail holds the list.
+// Server errors with an HTML body, like Buildkite's maintenance page, are
+// reported as an outage; see IsUnavailable.
+func parseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	rerr := &resterror.Error{Status: resp.StatusCode}
+	var val struct {
+		Message string            `json:"message"`
+		Errors  []json.RawMessage `json:"errors"`
+	}
+	if resp.StatusCode >= 500 && isHTML(resp, body) {
+		rerr.ID = unavailableID
+		rerr.Title = fmt.Sprintf("Buildkite appears to be down (HTTP %d)", resp.StatusCode)
+		return rerr
+	}
+	if err := json.Unmarshal(body, &val); err == nil && val.Message != "" {
+		rerr.Title = val.Message
+		if msgs := validationErrors(val.Errors); len(msgs) > 0 {
+			rerr.Detail = strings.Join(msgs, "; ")
+			// resterror.Error only prints the Title, so add the
+			// fields there too.
+			rerr.Title += ": " + rerr.Detail
+		}
+	} else if len(body) > 0 {
+		rerr.Title = fmt.Sprintf("%s: %s", http.StatusText(resp.StatusCode), bytes.TrimSpace(body))
+	} else {
+		rerr.Title = http.StatusText(resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// resterror.Error only prints the Title, so put the hint there.
+		rerr.Title += ". Check the token in your config file, or create a new one at https://buildkite.com/user/api-access-tokens"
+	}
+	return rerr
+}
+
+// unavailableID is the resterror.Error ID of errors for Buildkite outages.
+const unavailableID = "unavailable"
+
+// isHTML reports whether a response is a web page, rather than an API
+// response.
+func isHTML(resp *http.Response, body []byte) bool {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
+
+// IsUnavailable reports whether err means Buildkite is down, for example
+// because it returned a maintenance page instead of an API response. Requests
+// that fail this way are worth retrying later.
+func IsUnavailable(err error) bool {
+	var rerr *resterror.Error
+	return errors.As(err, &rerr) && rerr.ID == unavailableID
+}
+
+// Client makes requests to the Buildkite API. A Client is safe for concurrent
+// use by multiple goroutines, and reuses HTTP connections between requests,
+// so it should be created once and shared. Don't modify its fields while
+// requests are in flight.
 type Client struct {
 	*restclient.Client
 	APIVersion string
+	// mu guards Token, which refreshAfter may replace while other requests
+	// are being built.
+	mu sync.RWMutex
+	// RefreshToken, if set, is called to get a new API token when a request
+	// fails with a 401, for example because a short-lived token from a
+	// secret manager expired. The request is retried once with the new
+	// token.
+	RefreshToken func() (string, error)
+	// FailureOptions, if set, control how BuildSummary finds the failure in
+	// a job's log.
+	FailureOptions *FailureOptions
+}
+
+// refreshAfter reports whether err is a 401 for a request sent with the token
+// sent, and the client now has a different token, meaning the request should
+// be retried. If another request has already replaced sent, the new token is
+// used without calling RefreshToken again.
+func (c *Client) refreshAfter(err error, sent string) bool {
+	var rerr *resterror.Error
+	if !errors.As(err, &rerr) || rerr.Status != http.StatusUnauthorized || c.RefreshToken == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Token != sent {
+		return true
+	}
+	token, refreshErr := c.RefreshToken()
+	if refreshErr != nil || token == "" || token == sent {
+		return false
+	}
+	c.Token = token
+	return true
+}
+
+// newRequest is like NewRequestWithContext, but is safe to call while the
+// token is being refreshed. It also returns the token the request is sent
+// with.
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	req, err := c.NewRequestWithContext(ctx, method, path, body)
+	return req, c.Token, err
+}
+
+// httpClient returns the *http.Client that requests are made with.
+func (c *Client) httpClient() *http.Client {
+	if c.Client.Client != nil {
+		return c.Client.Client
+	}
+	return &http.Client{Transport: restclient.DefaultTransport}
+}
+
+// Close closes any idle HTTP connections held by the client's transport. The
+// client can still be used afterwards; new connections will be opened as
+// needed. Note that clients created without a custom *http.Client share a
+// transport, so Close closes idle connections for all of them.
+func (c *Client) Close() {
+	var transport http.RoundTripper = http.DefaultTransport
+	if t := c.httpClient().Transport; t != nil {
+		transport = t
+	}
+	// restclient wraps the real transport to add debugging hooks, and the
+	// wrapper doesn't pass CloseIdleConnections through.
+	if rt, ok := transport.(*restclient.Transport); ok && rt.RoundTripper != nil {
+		transport = rt.RoundTripper
+	}
+	if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
 }
 
 // GetResource retrieves an instance resource with the given path part (e.g.
@@ -66,6 +268,15 @@ func (c *Client) DeleteResource(ctx context.Context, pathPart string, sid string
 }
 
 func (c *Client) MakeRequest(ctx context.Context, method string, pathPart string, data url.Values, v interface{}) error {
+	sent, err := c.makeRequest(ctx, method, pathPart, data, v)
+	if err != nil && c.refreshAfter(err, sent) {
+		_, err = c.makeRequest(ctx, method, pathPart, data, v)
+	}
+	return err
+}
+
+// makeRequest makes a request, and returns the token it was sent with.
+func (c *Client) makeRequest(ctx context.Context, method string, pathPart string, data url.Values, v interface{}) (string, error) {
 	rb := new(strings.Reader)
 	if data != nil && (method == "POST" || method == "PUT") {
 		rb = strings.NewReader(data.Encode())
@@ -73,16 +284,16 @@ func (c *Client) MakeRequest(ctx context.Context, method string, pathPart string
 	if method == "GET" && data != nil {
 		pathPart = pathPart + "?" + data.Encode()
 	}
-	req, err := c.NewRequestWithContext(ctx, method, "/"+APIVersion+pathPart, rb)
+	req, token, err := c.newRequest(ctx, method, "/"+APIVersion+pathPart, rb)
 	if err != nil {
-		return err
+		return "", err
 	}
 	if ua := req.Header.Get("User-Agent"); ua == "" {
 		req.Header.Set("User-Agent", userAgent)
 	} else {
 		req.Header.Set("User-Agent", userAgent+" "+ua)
 	}
-	return c.Do(req, &v)
+	return token, c.Do(req, &v)
 }
 
 func (c *Client) ListResource(ctx context.Context, pathPart string, data url.Values, v interface{}) error {
@@ -108,6 +319,25 @@ func (o *OrganizationService) Pipeline(pipeline string) *PipelineService {
 	}
 }
 
+// ListPipelines returns a page of the pipelines in the organization. Use the
+// "page" and "per_page" query parameters to page through the results.
+func (o *OrganizationService) ListPipelines(ctx context.Context, query url.Values) (ListPipelineResponse, error) {
+	path := "/organizations/" + o.org + "/pipelines"
+	var val ListPipelineResponse
+	err := o.client.ListResource(ctx, path, query, &val)
+	return val, err
+}
+
+// ListBuilds returns a page of the builds in every pipeline in the
+// organization, most recent first. Use query to filter the results, e.g. by
+// "commit" or "state".
+func (o *OrganizationService) ListBuilds(ctx context.Context, query url.Values) (ListBuildResponse, error) {
+	path := "/organizations/" + o.org + "/builds"
+	var val ListBuildResponse
+	err := o.client.ListResource(ctx, path, query, &val)
+	return val, err
+}
+
 type BuildService struct {
 	client   *Client
 	org      string
@@ -131,6 +361,16 @@ func (p *PipelineService) ListBuilds(ctx context.Context, query url.Values) (Lis
 	return val, err
 }
 
+// CreateBuild starts a new build of the pipeline. data must include "commit"
+// and "branch"; see the Buildkite API docs for the other parameters, e.g.
+// "message" or "env[NAME]".
+func (p *PipelineService) CreateBuild(ctx context.Context, data url.Values) (Build, error) {
+	path := "/organizations/" + p.org + "/pipelines/" + p.pipeline + "/builds"
+	var val Build
+	err := p.client.CreateResource(ctx, path, data, &val)
+	return val, err
+}
+
 type JobService struct {
 	client      *Client
 	org         string
@@ -154,11 +394,44 @@ func (b *BuildService) Path() string {
 		b.org, b.pipeline, b.number)
 }
 
+// IncludeRetriedJobs is the query parameter that makes Get and ListBuilds
+// return every attempt of a retried job, instead of only the last one, e.g.
+// url.Values{IncludeRetriedJobs: {"true"}}.
+const IncludeRetriedJobs = "include_retried_jobs"
+
+// Get retrieves a single build, including the full details for each of its
+// jobs.
+func (b *BuildService) Get(ctx context.Context, query url.Values) (Build, error) {
+	var val Build
+	err := b.client.ListResource(ctx, b.Path(), query, &val)
+	return val, err
+}
+
+// Cancel cancels the build, if it's scheduled or running, and returns the
+// updated build.
+func (b *BuildService) Cancel(ctx context.Context) (Build, error) {
+	var val Build
+	err := b.client.MakeRequest(ctx, "PUT", b.Path()+"/cancel", nil, &val)
+	return val, err
+}
+
+// Rebuild starts a new build with the same commit, branch and environment as
+// this one, and returns the new build.
+func (b *BuildService) Rebuild(ctx context.Context) (Build, error) {
+	var val Build
+	err := b.client.MakeRequest(ctx, "PUT", b.Path()+"/rebuild", nil, &val)
+	return val, err
+}
+
+// Annotations retrieves the annotations on the build. If query has a "context"
+// or "style" value, only annotations matching it are returned.
 func (b *BuildService) Annotations(ctx context.Context, query url.Values) (AnnotationResponse, error) {
 	path := b.Path() + "/annotations"
 	var val AnnotationResponse
-	err := b.client.ListResource(ctx, path, query, &val)
-	return val, err
+	if err := b.client.ListResource(ctx, path, query, &val); err != nil {
+		return nil, err
+	}
+	return val.Filter(query.Get("context"), query.Get("style")), nil
 }
 
 func (j *JobService) Path() string {
@@ -173,25 +446,136 @@ func (j *JobService) Log(ctx context.Context) (Log, error) {
 	return val, err
 }
 
+// Env returns the environment variables that were set for the job.
+func (j *JobService) Env(ctx context.Context) (map[string]string, error) {
+	var val struct {
+		Env map[string]string `json:"env"`
+	}
+	err := j.client.ListResource(ctx, j.Path()+"/env", nil, &val)
+	return val.Env, err
+}
+
+// Retry retries the job, returning the new job that was created.
+func (j *JobService) Retry(ctx context.Context) (Job, error) {
+	var val Job
+	err := j.client.MakeRequest(ctx, "PUT", j.Path()+"/retry", nil, &val)
+	return val, err
+}
+
+// Unblock unblocks a block step, so the rest of the build can run, and
+// returns the updated job.
+func (j *JobService) Unblock(ctx context.Context) (Job, error) {
+	var val Job
+	err := j.client.MakeRequest(ctx, "PUT", j.Path()+"/unblock", nil, &val)
+	return val, err
+}
+
+// RawLog returns the job's log output. For large logs, use StreamRawLog to
+// avoid holding the whole log in memory.
 func (j *JobService) RawLog(ctx context.Context) ([]byte, error) {
-	req, err := j.client.NewRequestWithContext(ctx, "GET", "/"+APIVersion+j.Path()+"/log", nil)
-	if err != nil {
+	buf := new(bytes.Buffer)
+	if err := j.StreamRawLog(ctx, buf); err != nil {
 		return nil, err
 	}
+	return buf.Bytes(), nil
+}
+
+// StreamRawLog copies the job's log output to w as it is downloaded. If the
+// API responds with an error status, nothing is written to w.
+func (j *JobService) StreamRawLog(ctx context.Context, w io.Writer) error {
+	sent, err := j.streamRawLog(ctx, w)
+	if err != nil && j.client.refreshAfter(err, sent) {
+		_, err = j.streamRawLog(ctx, w)
+	}
+	return err
+}
+
+// streamRawLog copies the job's log to w, and returns the token the request
+// was sent with.
+func (j *JobService) streamRawLog(ctx context.Context, w io.Writer) (string, error) {
+	req, sent, err := j.client.newRequest(ctx, "GET", "/"+APIVersion+j.Path()+"/log", nil)
+	if err != nil {
+		return sent, err
+	}
 	req.Header.Set("Accept", "text/plain")
-	resp, err := j.client.Client.Client.Do(req)
+	// http.Transport asks for gzip on its own, but only when it's the
+	// transport in use, and it doesn't handle deflate. Ask explicitly so large
+	// logs are compressed no matter how the client was configured.
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	// Use the same *http.Client as every other request, so connections are
+	// pooled.
+	resp, err := j.client.httpClient().Do(req)
 	if err != nil {
-		return nil, err
+		return sent, err
+	}
+	if err := decodeBody(resp); err != nil {
+		resp.Body.Close()
+		return sent, err
 	}
 	if resp.StatusCode >= 300 {
-		return nil, restclient.DefaultErrorParser(resp)
+		return sent, parseError(resp)
 	}
 	defer resp.Body.Close()
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	_, err = io.Copy(w, resp.Body)
+	return sent, err
+}
+
+// decompressedBody closes both the decompressor and the response body.
+type decompressedBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (d *decompressedBody) Close() error {
+	err := d.ReadCloser.Close()
+	if berr := d.body.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
+
+// decodeBody replaces resp.Body with a reader that decompresses it, according
+// to the Content-Encoding header. Setting Accept-Encoding on a request turns
+// off http.Transport's own gzip handling, so it needs to be done by hand.
+func decodeBody(resp *http.Response) error {
+	var r io.ReadCloser
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		r = zr
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		r = zr
+	default:
+		return nil
 	}
-	return data, nil
+	resp.Body = &decompressedBody{ReadCloser: r, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// CurrentUser returns the user that owns the client's API token.
+func (c *Client) CurrentUser(ctx context.Context) (User, error) {
+	var val User
+	err := c.ListResource(ctx, "/user", nil, &val)
+	return val, err
+}
+
+// ListOrganizations returns a page of the organizations the client's API
+// token can access.
+func (c *Client) ListOrganizations(ctx context.Context, query url.Values) (ListOrganizationResponse, error) {
+	var val ListOrganizationResponse
+	err := c.ListResource(ctx, "/organizations", query, &val)
+	return val, err
 }
 
 func (c *Client) Organization(org string) *OrganizationService {
@@ -202,7 +586,11 @@ func isatty() bool {
 	return term.IsTerminal(int(os.Stdout.Fd()))
 }
 
-func (c *Client) BuildSummary(ctx context.Context, org string, build Build, numOutputLines int) []byte {
+// BuildSummary returns a table of the build's jobs and how long they took,
+// followed by the last numOutputLines lines of output of the first failed job
+// with any. pipeline is the pipeline's slug, used to fetch the logs if the
+// build doesn't include it, as builds from ListBuilds sometimes don't.
+func (c *Client) BuildSummary(ctx context.Context, org, pipeline string, build Build, numOutputLines int) []byte {
 	var buf bytes.Buffer
 	buf.Write([]byte{'\n'}) // the end of the '=' line
 	writer := tabwriter.NewWriter(&buf, 0, 0, 1, ' ', 0)
@@ -223,28 +611,48 @@ func (c *Client) BuildSummary(ctx context.Context, org string, build Build, numO
 	*/
 	var failure []byte
 	for i := range build.Jobs {
-		duration := build.Jobs[i].FinishedAt.Time.Sub(build.Jobs[i].StartedAt)
+		duration := build.Jobs[i].Duration()
 		if duration > time.Minute {
 			duration = duration.Round(time.Second)
 		} else {
 			duration = duration.Round(10 * time.Millisecond)
 		}
 		var durString string
-		if build.Jobs[i].Failed() && isatty() {
+		if build.Jobs[i].StartedAt.IsZero() {
+			// The job never ran; either it's still waiting for an agent, or
+			// it was skipped or canceled before it could start.
+			if build.Jobs[i].FinishedAt.Valid {
+				durString = "-"
+			} else {
+				durString = "queued"
+			}
+		} else if build.Jobs[i].Failed() && isatty() {
 			durString = fmt.Sprintf("\033[38;05;160m%-8s\033[0m", duration.String())
 		} else {
 			durString = duration.String()
 		}
-		if build.Jobs[i].Failed() && failure == nil {
-			logs, err := c.Organization(org).Pipeline(build.Pipeline.Slug).Build(build.Number).Job(build.Jobs[i].ID).RawLog(ctx)
-			if err == nil {
-				// TODO: configure based on window?
-				failure = FindBuildFailure(logs, numOutputLines)
-			}
+		name := build.Jobs[i].Name
+		if build.Jobs[i].Retried {
+			name += " (retried)"
 		}
-		fmt.Fprintf(writer, "%s\t%s\n", build.Jobs[i].Name, durString)
+		fmt.Fprintf(writer, "%s\t%s\n", name, durString)
 	}
 	writer.Flush()
+	// Jobs that never ran (e.g. "broken" jobs) have no logs, so keep going
+	// until we find a failed job with some output.
+	if build.Pipeline.Slug != "" {
+		pipeline = build.Pipeline.Slug
+	}
+	for _, job := range build.FailedJobs() {
+		logs, err := c.Organization(org).Pipeline(pipeline).Build(build.Number).Job(job.ID).RawLog(ctx)
+		if err != nil {
+			continue
+		}
+		// TODO: configure based on window?
+		if failure = FindBuildFailureWithOptions(logs, numOutputLines, c.FailureOptions); len(failure) > 0 {
+			break
+		}
+	}
 	linelen := bytes.IndexByte(buf.Bytes()[1:], '\n')
 	var buf2 bytes.Buffer
 	buf2.WriteByte('\n')
@@ -0,0 +1,335 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kevinburke/rest/restclient"
+	"github.com/kevinburke/rest/resterror"
+)
+
+type countingTransport struct {
+	count int32
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.count, 1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewClientWithHTTPClient(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/organizations/example/pipelines/app/builds" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer my-token" {
+			t.Errorf("unexpected Authorization header %q", auth)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buildsResponse)
+	}))
+	defer s.Close()
+	transport := new(countingTransport)
+	client := NewClientWithHTTPClient("my-token", &http.Client{Transport: transport})
+	client.Base = s.URL
+	builds, err := client.Organization("example").Pipeline("app").ListBuilds(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 3 {
+		t.Errorf("expected 3 builds, got %d", len(builds))
+	}
+	if n := atomic.LoadInt32(&transport.count); n != 1 {
+		t.Errorf("expected custom transport to be used once, got %d", n)
+	}
+}
+
+func TestCreateBuild(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/v2/organizations/example/pipelines/app/builds" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/x-www-form-urlencoded") {
+			t.Errorf("unexpected Content-Type %q", ct)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		if r.PostForm.Get("commit") != "abc" || r.PostForm.Get("env[FOO]") != "bar" {
+			t.Errorf("unexpected form: %v", r.PostForm)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"number": 7, "state": "scheduled", "web_url": "https://buildkite.com/example/app/builds/7"}`))
+	}))
+	defer s.Close()
+	client := NewClientWithHTTPClient("my-token", s.Client())
+	client.Base = s.URL
+	build, err := client.Organization("example").Pipeline("app").CreateBuild(context.Background(), url.Values{
+		"commit":   []string{"abc"},
+		"branch":   []string{"main"},
+		"env[FOO]": []string{"bar"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Number != 7 || build.State != "scheduled" {
+		t.Errorf("unexpected build: %#v", build)
+	}
+}
+
+type closeTracker struct {
+	countingTransport
+	closed int32
+}
+
+func (c *closeTracker) CloseIdleConnections() {
+	atomic.AddInt32(&c.closed, 1)
+}
+
+func TestClose(t *testing.T) {
+	inner := new(closeTracker)
+	client := NewClientWithHTTPClient("test-token", &http.Client{
+		Transport: &restclient.Transport{RoundTripper: inner},
+	})
+	client.Close()
+	if inner.closed != 1 {
+		t.Errorf("expected Close to close idle connections once, got %d", inner.closed)
+	}
+}
+
+func TestRawLogUsesHTTPClient(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello\n"))
+	}))
+	defer s.Close()
+	transport := new(countingTransport)
+	client := NewClientWithHTTPClient("test-token", &http.Client{Transport: transport})
+	client.Base = s.URL
+	job := client.Organization("example").Pipeline("app").Build(1).Job("abc")
+	for i := 0; i < 2; i++ {
+		if _, err := job.RawLog(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if transport.count != 2 {
+		t.Errorf("expected 2 requests through the custom transport, got %d", transport.count)
+	}
+}
+
+func TestStreamRawLog(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/organizations/example/pipelines/app/builds/1/jobs/missing/log" {
+			w.WriteHeader(404)
+			w.Write([]byte(`{"message":"Not Found"}`))
+			return
+		}
+		w.Write([]byte("line one\nline two\n"))
+	}))
+	defer s.Close()
+	client := NewClientWithHTTPClient("test-token", s.Client())
+	client.Base = s.URL
+	build := client.Organization("example").Pipeline("app").Build(1)
+
+	buf := new(bytes.Buffer)
+	if err := build.Job("abc").StreamRawLog(context.Background(), buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "line one\nline two\n" {
+		t.Errorf("unexpected log output %q", buf.String())
+	}
+
+	buf.Reset()
+	err := build.Job("missing").StreamRawLog(context.Background(), buf)
+	if rerr, ok := err.(*resterror.Error); !ok || rerr.Status != 404 {
+		t.Errorf("expected 404 error, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing written on error, got %q", buf.String())
+	}
+}
+
+func TestStreamRawLogCompressed(t *testing.T) {
+	const log = "--- FAIL: TestSomething\nexit status 1\n"
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if accept := r.Header.Get("Accept-Encoding"); !strings.Contains(accept, encoding) {
+					t.Errorf("expected Accept-Encoding to include %s, got %q", encoding, accept)
+				}
+				buf := new(bytes.Buffer)
+				var zw io.WriteCloser
+				if encoding == "gzip" {
+					zw = gzip.NewWriter(buf)
+				} else {
+					zw = zlib.NewWriter(buf)
+				}
+				zw.Write([]byte(log))
+				zw.Close()
+				w.Header().Set("Content-Encoding", encoding)
+				w.Write(buf.Bytes())
+			}))
+			defer s.Close()
+			client := NewClientWithHTTPClient("test-token", s.Client())
+			client.Base = s.URL
+			data, err := client.Organization("example").Pipeline("app").Build(1).Job("abc").RawLog(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != log {
+				t.Errorf("expected decompressed log, got %q", data)
+			}
+		})
+	}
+}
+
+func TestCancelBuild(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v2/organizations/example/pipelines/app/builds/7/cancel" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"number": 7, "state": "canceling"}`))
+	}))
+	defer s.Close()
+	client := NewClientWithHTTPClient("test-token", s.Client())
+	client.Base = s.URL
+	build, err := client.Organization("example").Pipeline("app").Build(7).Cancel(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.State != "canceling" {
+		t.Errorf("expected canceling build, got %q", build.State)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v2/organizations/example/pipelines/app/builds/7/rebuild" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"number": 12, "state": "scheduled", "commit": "abc"}`))
+	}))
+	defer s.Close()
+	client := NewClientWithHTTPClient("test-token", s.Client())
+	client.Base = s.URL
+	build, err := client.Organization("example").Pipeline("app").Build(7).Rebuild(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Number != 12 || build.State != "scheduled" {
+		t.Errorf("expected scheduled build 12, got build %d (%s)", build.Number, build.State)
+	}
+}
+
+// proxyFunc returns the Proxy function of the *http.Transport that client
+// sends requests through.
+func proxyFunc(t *testing.T, client *Client) func(*http.Request) (*url.URL, error) {
+	t.Helper()
+	rt, ok := client.httpClient().Transport.(*restclient.Transport)
+	if !ok {
+		t.Fatalf("expected a *restclient.Transport, got %T", client.httpClient().Transport)
+	}
+	transport := rt.RoundTripper
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	ht, ok := transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("expected an *http.Transport, got %T", transport)
+	}
+	return ht.Proxy
+}
+
+func TestProxy(t *testing.T) {
+	// Both API requests and log downloads use the client's transport, so
+	// they use the same proxy.
+	if proxyFunc(t, NewClient("test-token")) == nil {
+		t.Error("expected the default client to use the proxy from the environment")
+	}
+	hc, err := NewProxyHTTPClient("http://proxy.example.com:3128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := proxyFunc(t, NewClientWithHTTPClient("test-token", hc))
+	req := httptest.NewRequest("GET", "https://api.buildkite.com/v2/user", nil)
+	u, err := proxy(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u == nil || u.Host != "proxy.example.com:3128" {
+		t.Errorf("expected requests to go through proxy.example.com:3128, got %v", u)
+	}
+	for _, bad := range []string{"proxy.example.com", "://"} {
+		if _, err := NewProxyHTTPClient(bad); err == nil {
+			t.Errorf("NewProxyHTTPClient(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestParseValidationError(t *testing.T) {
+	tests := []struct {
+		body  string
+		title string
+	}{
+		{`{"message": "Validation Failed", "errors": ["Branch can't be blank", "Commit can't be blank"]}`,
+			"Validation Failed: Branch can't be blank; Commit can't be blank"},
+		{`{"message": "Validation Failed", "errors": [{"field": "branch", "code": "missing"}, {"field": "env", "message": "is invalid"}]}`,
+			"Validation Failed: branch missing; env is invalid"},
+		{`{"message": "Validation Failed"}`, "Validation Failed"},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{
+			StatusCode: http.StatusUnprocessableEntity,
+			Body:       io.NopCloser(strings.NewReader(tt.body)),
+		}
+		rerr, ok := parseError(resp).(*resterror.Error)
+		if !ok {
+			t.Fatalf("expected a *resterror.Error for %s", tt.body)
+		}
+		if rerr.Status != 422 || rerr.Error() != tt.title {
+			t.Errorf("parseError(%s): got %d %q, want 422 %q", tt.body, rerr.Status, rerr.Error(), tt.title)
+		}
+	}
+}
+
+func TestParseErrorMaintenancePage(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Content-Type": []string{"text/html; charset=utf-8"}},
+		Body:       io.NopCloser(strings.NewReader("<!DOCTYPE html>\n<html><body><h1>Buildkite is down for maintenance</h1></body></html>")),
+	}
+	err := parseError(resp)
+	if !IsUnavailable(err) {
+		t.Errorf("expected an unavailable error, got %v", err)
+	}
+	if want := "Buildkite appears to be down (HTTP 503)"; err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+	// Without a content type, the leading "<" gives it away.
+	resp = &http.Response{
+		StatusCode: http.StatusBadGateway,
+		Body:       io.NopCloser(strings.NewReader("  <html>Bad Gateway</html>")),
+	}
+	if err := parseError(resp); !IsUnavailable(err) {
+		t.Errorf("expected an unavailable error, got %v", err)
+	}
+	// JSON server errors are reported as they are.
+	resp = &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       io.NopCloser(strings.NewReader(`{"message": "Try again later"}`)),
+	}
+	if err := parseError(resp); IsUnavailable(err) || err.Error() != "Try again later" {
+		t.Errorf("expected the API's message, got %v", err)
+	}
+}
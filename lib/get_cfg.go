@@ -13,36 +13,40 @@ func checkFile(path string) bool {
 	return !errors.Is(err, os.ErrNotExist)
 }
 
-// Check for the following config paths:
-// - $XDG_CONFIG_HOME/buildkite
+// ConfigPaths returns the locations where LoadConfig looks for a config file,
+// in the order it checks them:
+//
+// - $XDG_CONFIG_HOME/buildkite, if XDG_CONFIG_HOME is set
 // - $HOME/cfg/buildkite
 // - $HOME/.buildkite
-
-func getCfgPath() (string, error) {
-	checkedLocations := make([]string, 0)
-
-	xdgPath, ok := os.LookupEnv("XDG_CONFIG_HOME")
-	filePath := filepath.Join(xdgPath, "buildkite")
-	checkedLocations = append(checkedLocations, filePath)
-	if ok && checkFile(filePath) {
-		return filePath, nil
+func ConfigPaths() ([]string, error) {
+	var paths []string
+	if xdgPath, ok := os.LookupEnv("XDG_CONFIG_HOME"); ok {
+		paths = append(paths, filepath.Join(xdgPath, "buildkite"))
 	}
-
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return "", fmt.Errorf("retrieving home directory info: %w", err)
+		return nil, fmt.Errorf("retrieving home directory info: %w", err)
 	}
+	paths = append(paths, filepath.Join(homeDir, "cfg", "buildkite"), filepath.Join(homeDir, ".buildkite"))
+	return paths, nil
+}
 
-	cfgPath := filepath.Join(homeDir, "cfg", "buildkite")
-	checkedLocations = append(checkedLocations, cfgPath)
-	if checkFile(cfgPath) {
-		return cfgPath, nil
-	}
+// ConfigPath returns the path of the config file that LoadConfig loads, or an
+// error listing the locations it checked if there isn't one.
+func ConfigPath() (string, error) {
+	return getCfgPath()
+}
 
-	localPath := filepath.Join(homeDir, ".buildkite")
-	checkedLocations = append(checkedLocations, localPath)
-	if checkFile(localPath) {
-		return localPath, nil
+func getCfgPath() (string, error) {
+	paths, err := ConfigPaths()
+	if err != nil {
+		return "", err
+	}
+	for _, path := range paths {
+		if checkFile(path) {
+			return path, nil
+		}
 	}
 
 	return "", //lint:ignore ST1005 this shows up in public facing error.
@@ -57,5 +61,5 @@ Add a configuration file with your Buildkite token, like this:
     git_remotes = [ "github_org" ]
 
 Go to https://buildkite.com/user/api-access-tokens if you need to find your token.
-`, strings.Join(checkedLocations, " or "))
+`, strings.Join(paths, " or "))
 }
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -34,6 +37,12 @@ type Build struct {
 	Jobs        []Job          `json:"jobs"`
 	Pipeline    Pipeline       `json:"pipeline"`
 	PullRequest *PullRequest   `json:"pull_request"`
+	// The user who started the build, or nil if it wasn't started by a
+	// user (e.g. it was started by a webhook or on a schedule).
+	Creator *User `json:"creator"`
+	// What started the build: "webhook", "api", "ui", "trigger_job" or
+	// "schedule".
+	Source string `json:"source"`
 }
 
 type PullRequest struct {
@@ -42,18 +51,66 @@ type PullRequest struct {
 	Repository string `json:"repository"`
 }
 
+// Provider is a service that hosts git repositories.
+type Provider string
+
+const (
+	GitHub    Provider = "github"
+	GitLab    Provider = "gitlab"
+	Bitbucket Provider = "bitbucket"
+)
+
+// DetectProvider guesses which provider hosts repositories on host, e.g.
+// "gitlab.com". Self-hosted GitLab and Bitbucket servers are only detected if
+// their host name contains "gitlab" or "bitbucket"; every other host is
+// assumed to be GitHub or GitHub Enterprise.
+func DetectProvider(host string) Provider {
+	host = strings.ToLower(host)
+	switch {
+	case strings.Contains(host, "gitlab"):
+		return GitLab
+	case strings.Contains(host, "bitbucket"):
+		return Bitbucket
+	default:
+		return GitHub
+	}
+}
+
+// URL returns the web URL of the pull request (or merge request, on GitLab).
 func (p PullRequest) URL() string {
+	return p.ProviderURL("")
+}
+
+// ProviderURL is like URL, but builds the URL the way provider does, for
+// self-hosted servers that DetectProvider can't identify. An empty provider
+// means to detect it from the repository's host.
+func (p PullRequest) ProviderURL(provider Provider) string {
 	u, err := url.Parse(p.Repository)
 	if err != nil {
 		return "%!ERROR"
 	}
-	return fmt.Sprintf("%s://%s%s/pull/%s", u.Scheme, u.Host, strings.TrimSuffix(u.Path, ".git"), p.ID)
+	if provider == "" {
+		provider = DetectProvider(u.Hostname())
+	}
+	var prPath string
+	switch provider {
+	case GitLab:
+		prPath = "/-/merge_requests/"
+	case Bitbucket:
+		prPath = "/pull-requests/"
+	default:
+		prPath = "/pull/"
+	}
+	return fmt.Sprintf("%s://%s%s%s%s", u.Scheme, u.Host, strings.TrimSuffix(u.Path, ".git"), prPath, p.ID)
 }
 
 type Pipeline struct {
 	ID                   string    `json:"id"`
 	Name                 string    `json:"name"`
 	Slug                 string    `json:"slug"`
+	Repository           string    `json:"repository"`
+	WebURL               string    `json:"web_url"`
+	DefaultBranch        string    `json:"default_branch"`
 	CreatedAt            time.Time `json:"created_at"`
 	RunningBuildsCount   int       `json:"running_builds_count"`
 	ScheduledBuildsCount int       `json:"scheduled_builds_count"`
@@ -63,6 +120,7 @@ type Pipeline struct {
 
 type Job struct {
 	ID          string         `json:"id"`
+	Type        string         `json:"type"`
 	Name        string         `json:"name"`
 	Command     string         `json:"command"`
 	State       JobState       `json:"state"`
@@ -71,6 +129,50 @@ type Job struct {
 	ScheduledAt types.NullTime `json:"scheduled_at"`
 	FinishedAt  types.NullTime `json:"finished_at"`
 	LogURL      string         `json:"log_url"`
+	// The exit status of the job's command, or nil if it hasn't finished.
+	ExitStatus *int `json:"exit_status"`
+	// For "trigger" jobs, the build that the job started, or nil if it
+	// hasn't started one yet.
+	TriggeredBuild *TriggeredBuild `json:"triggered_build"`
+	// Block steps ("manual" jobs) have a label instead of a name.
+	Label string `json:"label"`
+	// For block steps, whether the API token's user can unblock the job.
+	Unblockable bool `json:"unblockable"`
+	// Whether the job was retried, meaning a later attempt replaced it.
+	// Retried jobs are only returned if the IncludeRetriedJobs query
+	// parameter is set.
+	Retried        bool   `json:"retried"`
+	RetriedInJobID string `json:"retried_in_job_id"`
+}
+
+// TriggeredBuild is a build started by a trigger step in another build.
+type TriggeredBuild struct {
+	ID     string `json:"id"`
+	Number int64  `json:"number"`
+	// The API URL of the build, e.g.
+	// https://api.buildkite.com/v2/organizations/example/pipelines/app/builds/5
+	URL    string `json:"url"`
+	WebURL string `json:"web_url"`
+}
+
+// Pipeline returns the organization and pipeline slug of the triggered build,
+// parsed from its URL.
+func (t TriggeredBuild) Pipeline() (org string, slug string, ok bool) {
+	if u, err := url.Parse(t.URL); err == nil {
+		// /v2/organizations/<org>/pipelines/<slug>/builds/<number>
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) >= 5 && parts[1] == "organizations" && parts[3] == "pipelines" {
+			return parts[2], parts[4], true
+		}
+	}
+	if u, err := url.Parse(t.WebURL); err == nil {
+		// /<org>/<slug>/builds/<number>
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		if len(parts) >= 3 && parts[2] == "builds" {
+			return parts[0], parts[1], true
+		}
+	}
+	return "", "", false
 }
 
 type Log struct {
@@ -79,9 +181,34 @@ type Log struct {
 	Content string `json:"content"`
 }
 
+// Failed reports whether the job failed. Jobs that were "broken" (didn't run
+// because of an earlier failure), timed out or were canceled count as
+// failures, as do jobs whose command exited with a non-zero status.
 func (j Job) Failed() bool {
-	// TODO
-	return j.State == "failed"
+	switch j.State {
+	case "failed", "broken", "timed_out", "canceled":
+		return true
+	}
+	return j.ExitStatus != nil && *j.ExitStatus != 0
+}
+
+// WebURL returns the URL of the job on the Buildkite website, given the web
+// URL of its build. Buildkite links to a job with an anchor on the build page.
+func (j Job) WebURL(buildWebURL string) string {
+	return buildWebURL + "#" + j.ID
+}
+
+// Duration returns how long the job ran for. If the job is still running,
+// Duration returns the time elapsed since it started. If the job has not
+// started, Duration returns 0.
+func (j Job) Duration() time.Duration {
+	if j.StartedAt.IsZero() {
+		return 0
+	}
+	if !j.FinishedAt.Valid {
+		return time.Since(j.StartedAt)
+	}
+	return j.FinishedAt.Time.Sub(j.StartedAt)
 }
 
 type JobState string
@@ -90,11 +217,107 @@ func (b Build) Empty() bool {
 	return b.Number == 0
 }
 
+// FailedJobs returns the jobs in the build that failed, in the order they
+// appear in the build.
+func (b Build) FailedJobs() []Job {
+	var jobs []Job
+	for _, job := range b.Jobs {
+		// A failed attempt that was retried didn't fail the build.
+		if job.Failed() && !job.Retried {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// BlockedJobs returns the block steps in the build that are waiting to be
+// unblocked.
+func (b Build) BlockedJobs() []Job {
+	var jobs []Job
+	for _, job := range b.Jobs {
+		if job.Type == "manual" && job.State == "blocked" {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// RunningJobs returns the jobs in the build that are currently running.
+func (b Build) RunningJobs() []Job {
+	var jobs []Job
+	for _, job := range b.Jobs {
+		if job.State == "running" {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// Running reports whether the build has started but not yet finished.
+func (b Build) Running() bool {
+	return !b.StartedAt.IsZero() && !b.FinishedAt.Valid
+}
+
+// Duration returns how long the build ran for. If the build is still running,
+// Duration returns the time elapsed since it started. If the build has not
+// started, Duration returns 0.
+func (b Build) Duration() time.Duration {
+	return b.DurationAt(time.Now())
+}
+
+// DurationAt is like Duration, but if the build is still running, returns
+// the time elapsed between when it started and now.
+func (b Build) DurationAt(now time.Time) time.Duration {
+	if b.StartedAt.IsZero() {
+		return 0
+	}
+	if !b.FinishedAt.Valid {
+		return now.Sub(b.StartedAt)
+	}
+	return b.FinishedAt.Time.Sub(b.StartedAt)
+}
+
+// TriggeredBuilds returns the builds started by trigger steps in the build.
+// Trigger jobs that haven't started a build yet are skipped.
+func (b Build) TriggeredBuilds() []TriggeredBuild {
+	var builds []TriggeredBuild
+	for _, job := range b.Jobs {
+		if job.Type == "trigger" && job.TriggeredBuild != nil {
+			builds = append(builds, *job.TriggeredBuild)
+		}
+	}
+	return builds
+}
+
+// User is a Buildkite user.
+type User struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	AvatarURL string    `json:"avatar_url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrganizationInfo is an organization as returned by the Buildkite API. See
+// Organization for the organizations in the config file.
+type OrganizationInfo struct {
+	ID        string    `json:"id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	WebURL    string    `json:"web_url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ListOrganizationResponse []OrganizationInfo
+
 type ListBuildResponse []Build
 
+type ListPipelineResponse []Pipeline
+
 type Annotation struct {
 	ID        string    `json:"id"`
 	Context   string    `json:"context"`
+	Style     string    `json:"style"`
 	BodyHTML  string    `json:"body_html"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
@@ -102,12 +325,80 @@ type Annotation struct {
 
 type AnnotationResponse []Annotation
 
+// Filter returns the annotations matching context and style. An empty context
+// or style matches any annotation.
+func (a AnnotationResponse) Filter(context, style string) AnnotationResponse {
+	var filtered AnnotationResponse
+	for _, annotation := range a {
+		if context != "" && annotation.Context != context {
+			continue
+		}
+		if style != "" && annotation.Style != style {
+			continue
+		}
+		filtered = append(filtered, annotation)
+	}
+	return filtered
+}
+
+// Failed returns the annotations with the "error" or "warning" style, leaving
+// out the "success" and "info" ones.
+func (a AnnotationResponse) Failed() AnnotationResponse {
+	var failed AnnotationResponse
+	for _, annotation := range a {
+		if annotation.Style == "error" || annotation.Style == "warning" {
+			failed = append(failed, annotation)
+		}
+	}
+	return failed
+}
+
 type Organization struct {
 	// This is the map key, so it needs to be explicitly set.
 	Name  string
 	Token string
+	// A shell command that prints the API token, e.g. "pass show buildkite",
+	// so the token doesn't need to be stored in the config file. If set, it
+	// is used instead of Token.
+	TokenCommand string `toml:"token_command"`
 	// List of git remotes that map to this Buildkite organization
 	GitRemotes []string `toml:"git_remotes"`
+	// The service that hosts the org's repositories: "github", "gitlab" or
+	// "bitbucket". This is used to link to pull requests. If empty, it's
+	// detected from the repository's host name.
+	GitProvider Provider `toml:"git_provider"`
+	// The branch to use when there's no current branch (for example, with a
+	// detached HEAD) or with -default-branch. If empty, it's detected from
+	// the git remote.
+	DefaultBranch string `toml:"default_branch"`
+	// The URL of an HTTP proxy to reach the Buildkite API through, e.g.
+	// "http://proxy.example.com:3128". If empty, the HTTP_PROXY, HTTPS_PROXY
+	// and NO_PROXY environment variables are used.
+	Proxy string `toml:"proxy"`
+}
+
+// APIToken returns the API token for the organization, running TokenCommand
+// to get it if one is configured.
+func (o Organization) APIToken() (string, error) {
+	if o.TokenCommand == "" {
+		return o.Token, nil
+	}
+	cmd := exec.Command("sh", "-c", o.TokenCommand)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return "", fmt.Errorf("running token_command for organization %s: %v", o.Name, err)
+		}
+		return "", fmt.Errorf("running token_command for organization %s: %v: %s", o.Name, err, msg)
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", fmt.Errorf("token_command for organization %s printed an empty token", o.Name)
+	}
+	return token, nil
 }
 
 // getCaseInsensitiveOrg finds the key in the list of orgs. This is a case
@@ -133,6 +424,37 @@ type FileConfig struct {
 	Default string
 	// Map key is the Buildkite name
 	Organizations map[string]Organization `toml:"organizations"`
+	// Pipelines maps a local repository path (e.g. "~/src/app") or a git
+	// remote (e.g. "github.com/example/app" or "example/app") to the Buildkite
+	// pipeline slug to use for it.
+	Pipelines map[string]string `toml:"pipelines"`
+}
+
+// PipelineFor returns the configured pipeline slug for the first of keys that
+// appears in the [pipelines] section of the config. Keys are local repository
+// paths or git remotes; a leading "~/" in the config is expanded to the home
+// directory.
+func (f *FileConfig) PipelineFor(keys ...string) (string, bool) {
+	if len(f.Pipelines) == 0 {
+		return "", false
+	}
+	home, _ := os.UserHomeDir()
+	normalized := make(map[string]string, len(f.Pipelines))
+	for k, slug := range f.Pipelines {
+		if home != "" && strings.HasPrefix(k, "~/") {
+			k = filepath.Join(home, k[2:])
+		}
+		normalized[strings.TrimSuffix(k, "/")] = slug
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if slug, ok := normalized[strings.TrimSuffix(key, "/")]; ok {
+			return slug, true
+		}
+	}
+	return "", false
 }
 
 // LoadConfig loads and marshals a config file from disk. LoadConfig will look
@@ -176,38 +498,118 @@ func LoadConfig(ctx context.Context) (*FileConfig, error) {
 	return &c, nil
 }
 
-func (f *FileConfig) OrgForRemote(gitRemote string) (Organization, bool) {
-	orgsByRemote := make(map[string]Organization)
-	for _, org := range f.Organizations {
+// orgNames returns the names of the configured organizations, sorted.
+func (f *FileConfig) orgNames() []string {
+	names := make([]string, 0, len(f.Organizations))
+	for name := range f.Organizations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// orgsByRemote maps each git remote in the config to its organization. If
+// more than one organization lists a remote, the first by name wins; see
+// DuplicateRemotes.
+func (f *FileConfig) orgsByRemote() map[string]Organization {
+	orgs := make(map[string]Organization)
+	for _, name := range f.orgNames() {
+		org := f.Organizations[name]
 		for _, rm := range org.GitRemotes {
-			orgsByRemote[rm] = org
+			if _, ok := orgs[rm]; !ok {
+				orgs[rm] = org
+			}
+		}
+	}
+	return orgs
+}
+
+// DuplicateRemote is a git remote listed by more than one organization.
+type DuplicateRemote struct {
+	Remote string
+	// The organizations that list the remote, sorted by name. The first one
+	// is used for the remote.
+	Orgs []string
+}
+
+// DuplicateRemotes returns the git remotes that more than one organization
+// lists in git_remotes, sorted by remote.
+func (f *FileConfig) DuplicateRemotes() []DuplicateRemote {
+	orgs := make(map[string][]string)
+	for _, name := range f.orgNames() {
+		for _, rm := range f.Organizations[name].GitRemotes {
+			orgs[rm] = append(orgs[rm], name)
+		}
+	}
+	var dups []DuplicateRemote
+	for rm, names := range orgs {
+		if len(names) > 1 {
+			dups = append(dups, DuplicateRemote{Remote: rm, Orgs: names})
 		}
 	}
-	org, ok := orgsByRemote[gitRemote]
+	sort.Slice(dups, func(i, j int) bool { return dups[i].Remote < dups[j].Remote })
+	return dups
+}
+
+func (f *FileConfig) OrgForRemote(gitRemote string) (Organization, bool) {
+	org, ok := f.orgsByRemote()[gitRemote]
 	return org, ok
 }
 
-// Token finds the token for a given git remote.
-func (f *FileConfig) Token(gitRemote string) (string, error) {
-	orgsByRemote := make(map[string]Organization)
-	for _, org := range f.Organizations {
-		for _, rm := range org.GitRemotes {
-			orgsByRemote[rm] = org
+// OrgForPipeline returns the organization for the pipeline with the given slug,
+// for commands that don't run in a git checkout. It looks for git remotes that
+// map to the slug in the [pipelines] section, and finds the organization for
+// the remote's owner (e.g. "example" in "github.com/example/app") by its
+// git_remotes or its name.
+func (f *FileConfig) OrgForPipeline(slug string) (Organization, bool) {
+	keys := make([]string, 0, len(f.Pipelines))
+	for k := range f.Pipelines {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if f.Pipelines[key] != slug || strings.HasPrefix(key, "/") || strings.HasPrefix(key, "~") {
+			// Local repository paths don't say which org they belong to.
+			continue
+		}
+		parts := strings.Split(strings.Trim(key, "/"), "/")
+		if len(parts) < 2 {
+			continue
+		}
+		owner := parts[len(parts)-2]
+		if org, ok := f.OrgForRemote(owner); ok {
+			return org, true
+		}
+		if org, ok := f.Org(owner); ok {
+			return org, true
 		}
 	}
+	return Organization{}, false
+}
+
+// Org finds the organization with the given Buildkite name. The match is case
+// insensitive.
+func (f *FileConfig) Org(name string) (Organization, bool) {
+	return getCaseInsensitiveOrg(name, f.Organizations)
+}
+
+// Token finds the token for a given git remote. If the organization has a
+// token_command, it is run to get the token.
+func (f *FileConfig) Token(gitRemote string) (string, error) {
+	orgsByRemote := f.orgsByRemote()
 	org, ok := getCaseInsensitiveOrg(gitRemote, orgsByRemote)
 	if ok {
-		return org.Token, nil
+		return org.APIToken()
 	}
 	if f.Default != "" {
 		defaultOrg, ok := getCaseInsensitiveOrg(f.Default, orgsByRemote)
 		if ok {
-			return defaultOrg.Token, nil
+			return defaultOrg.APIToken()
 		}
 		// try the other way too
 		defaultOrg, ok = getCaseInsensitiveOrg(f.Default, f.Organizations)
 		if ok {
-			return defaultOrg.Token, nil
+			return defaultOrg.APIToken()
 		}
 		//lint:ignore ST1005 this shows up in public facing error.
 		return "", fmt.Errorf(
@@ -244,9 +646,71 @@ func GetToken(ctx context.Context, org string) (string, error) {
 var postCommandHookRe = regexp.MustCompile(`~~~ Running (global|local|plugin) post-command hook`)
 var runCommandRe = regexp.MustCompile(`~~~ Running (global command|local command|plugin command|command|commands|script|batch script)\b`)
 
+// FailureOptions customize how FindBuildFailure finds the interesting part of
+// a log, for pipelines whose hooks print different headers. A nil field uses
+// the default.
+type FailureOptions struct {
+	// Start matches the header line of the section that runs the build
+	// command, e.g. "~~~ Running commands". The excerpt never reaches back past
+	// it.
+	Start *regexp.Regexp
+	// End matches the first text after the command section, e.g. "~~~ Running
+	// global post-command hook". The excerpt ends just before it.
+	End *regexp.Regexp
+	// KeepTimestamps keeps the escape sequences the Buildkite agent puts at
+	// the start of each line to record when it was printed. By default they
+	// are removed, since a terminal would print them as junk.
+	KeepTimestamps bool
+}
+
+// timestampRe matches the timestamps the Buildkite agent adds to each line of
+// a job's log, e.g. "\x1b_bk;t=1700000000000\x07". They are APC escape
+// sequences, which end with BEL or ST.
+var timestampRe = regexp.MustCompile(`\x1b_bk;t=\d*(?:\x07|\x1b\\)`)
+
+// StripTimestamps removes the Buildkite agent's timestamp escape sequences
+// from log, leaving other escape sequences (like colors) alone.
+func StripTimestamps(log []byte) []byte {
+	if !bytes.Contains(log, []byte("_bk;t=")) {
+		return log
+	}
+	return timestampRe.ReplaceAll(log, nil)
+}
+
+// collapseCarriageReturns turns CRLF line endings into LF, and replaces each
+// line that a tool redrew with "\r" (like a progress bar) with what it was last
+// redrawn as, so each line in the result is one line on a terminal.
+func collapseCarriageReturns(log []byte) []byte {
+	if bytes.IndexByte(log, '\r') == -1 {
+		return log
+	}
+	lines := bytes.Split(log, []byte{'\n'})
+	for i, line := range lines {
+		line = bytes.TrimRight(line, "\r")
+		if idx := bytes.LastIndexByte(line, '\r'); idx != -1 {
+			line = line[idx+1:]
+		}
+		lines[i] = line
+	}
+	return bytes.Join(lines, []byte{'\n'})
+}
+
 // FindBuildFailure will attempt to find the most "interesting" part of the log,
 // based on heuristics. At most numOutputLines will be displayed.
 func FindBuildFailure(log []byte, numOutputLines int) []byte {
+	return FindBuildFailureWithOptions(log, numOutputLines, nil)
+}
+
+// FindBuildFailureWithOptions is like FindBuildFailure, but uses the section
+// markers in opts, which may be nil.
+func FindBuildFailureWithOptions(log []byte, numOutputLines int, opts *FailureOptions) []byte {
+	startRe, endRe := runCommandRe, postCommandHookRe
+	if opts != nil && opts.Start != nil {
+		startRe = opts.Start
+	}
+	if opts != nil && opts.End != nil {
+		endRe = opts.End
+	}
 	// We want to find the "end" of the "Running script" section, which can
 	// contain an unknown number of tilde headers inside. I _believe_ the first
 	// bit after this is the "Running global post-command hook" stanza. So we
@@ -254,7 +718,11 @@ func FindBuildFailure(log []byte, numOutputLines int) []byte {
 	if len(log) == 0 {
 		return log
 	}
-	idxMatch := postCommandHookRe.FindIndex(log)
+	log = collapseCarriageReturns(log)
+	if opts == nil || !opts.KeepTimestamps {
+		log = StripTimestamps(log)
+	}
+	idxMatch := endRe.FindIndex(log)
 	if idxMatch == nil {
 		newlineIdx := 0
 		for count := 0; count < numOutputLines; count++ {
@@ -273,7 +741,7 @@ func FindBuildFailure(log []byte, numOutputLines int) []byte {
 		if newIdx == -1 {
 			return log[:idx]
 		}
-		if runCommandRe.Match(log[newIdx+1 : newlineIdx]) {
+		if startRe.Match(log[newIdx+1 : newlineIdx]) {
 			break
 		}
 		newlineIdx = newIdx
@@ -1,25 +1,386 @@
 package lib
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/kevinburke/rest/resterror"
 )
 
 func TestBuildFailure(t *testing.T) {
-	t.Skip("add an actual assertion here.")
+	client := newTestServer(t)
+	logs, err := client.Organization("example").Pipeline("app").Build(2).Job("job-failed").RawLog(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(FindBuildFailure(logs, 10))
+	if !strings.Contains(out, "--- FAIL: TestFoo") {
+		t.Errorf("failure output should contain the failing test, got %q", out)
+	}
+	if strings.Contains(out, "post-command hook") || strings.Contains(out, "setting up") {
+		t.Errorf("failure output should only contain the command section, got %q", out)
+	}
+}
+
+func TestBuildFailureLog(t *testing.T) {
 	var log Log
 	if err := json.Unmarshal(logResponse, &log); err != nil {
 		t.Fatal(err)
 	}
-	byteContent := []byte(log.Content)
-	if len(byteContent) < 1000 {
-		t.Error("did not unmarshal correct build object")
+	out := string(FindBuildFailure([]byte(log.Content), 10))
+	if !strings.Contains(out, "Successfully uploaded and parsed pipeline config") {
+		t.Errorf("failure output should contain the end of the command, got %q", out)
+	}
+	if strings.Contains(out, "pre-command hook") || strings.Contains(out, "post-command hook") {
+		t.Errorf("failure output should not contain hook headers, got %q", out)
+	}
+}
+
+func TestFindBuildFailureWithOptions(t *testing.T) {
+	log := []byte(`--- setting up
+checking out repo
++++ Build and test
+go test ./...
+--- FAIL: TestFoo
+FAIL
+--- Cleanup
+removing containers
+`)
+	opts := &FailureOptions{
+		Start: regexp.MustCompile(`^\+\+\+ Build and test`),
+		End:   regexp.MustCompile(`--- Cleanup`),
+	}
+	out := string(FindBuildFailureWithOptions(log, 10, opts))
+	want := "\ngo test ./...\n--- FAIL: TestFoo\nFAIL\n"
+	if out != want {
+		t.Errorf("FindBuildFailureWithOptions: got %q, want %q", out, want)
+	}
+	// The default markers don't match anything, so we get the start of the
+	// log.
+	if out := string(FindBuildFailure(log, 2)); out != "--- setting up\nchecking out repo" {
+		t.Errorf("FindBuildFailure: got %q", out)
+	}
+}
+
+func TestFindBuildFailureProgressBar(t *testing.T) {
+	log := []byte("~~~ Preparing working directory\r\n" +
+		"~~~ Running commands\r\n" +
+		"Downloading   0%\rDownloading  50%\rDownloading 100%\r\n" +
+		"--- FAIL: TestFoo\r\n" +
+		"FAIL\r\n" +
+		"~~~ Running global post-command hook\r\n")
+	out := string(FindBuildFailure(log, 10))
+	want := "\nDownloading 100%\n--- FAIL: TestFoo\nFAIL\n"
+	if out != want {
+		t.Errorf("FindBuildFailure: got %q, want %q", out, want)
+	}
+}
+
+func TestStripTimestamps(t *testing.T) {
+	in := "\x1b_bk;t=1700000000000\x07\x1b[31m--- FAIL: TestFoo\x1b[0m\n\x1b_bk;t=1700000000001\x1b\\FAIL\n"
+	want := "\x1b[31m--- FAIL: TestFoo\x1b[0m\nFAIL\n"
+	if got := string(StripTimestamps([]byte(in))); got != want {
+		t.Errorf("StripTimestamps: got %q, want %q", got, want)
+	}
+	log := []byte("\x1b_bk;t=1699999999999\x07~~~ Preparing working directory\n" +
+		"\x1b_bk;t=1700000000000\x07~~~ Running commands\n" +
+		"\x1b_bk;t=1700000000001\x07--- FAIL: TestFoo\n" +
+		"\x1b_bk;t=1700000000002\x07~~~ Running global post-command hook\n")
+	if out := string(FindBuildFailure(log, 10)); out != "\n--- FAIL: TestFoo\n" {
+		t.Errorf("FindBuildFailure: got %q", out)
+	}
+	out := string(FindBuildFailureWithOptions(log, 10, &FailureOptions{KeepTimestamps: true}))
+	if !strings.Contains(out, "_bk;t=1700000000001") {
+		t.Errorf("expected KeepTimestamps to keep the timestamp, got %q", out)
+	}
+}
+
+func TestGetBuild(t *testing.T) {
+	client := newTestServer(t)
+	build, err := client.Organization("example").Pipeline("app").Build(1).Get(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.State != "passed" || len(build.Jobs) != 1 {
+		t.Errorf("unexpected build: %#v", build)
+	}
+}
+
+func TestBuildSummaryFailed(t *testing.T) {
+	client := newTestServer(t)
+	build, err := client.Organization("example").Pipeline("app").Build(2).Get(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(client.BuildSummary(context.Background(), "example", "app", build, 10))
+	if !strings.Contains(out, "--- FAIL: TestFoo") {
+		t.Errorf("summary should contain the failure excerpt, got %q", out)
+	}
+}
+
+func TestBuildSummaryNoPipeline(t *testing.T) {
+	client := newTestServer(t)
+	build, err := client.Organization("example").Pipeline("app").Build(2).Get(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Builds from ListBuilds sometimes have an empty pipeline.
+	build.Pipeline.Slug = ""
+	out := string(client.BuildSummary(context.Background(), "example", "app", build, 10))
+	if !strings.Contains(out, "--- FAIL: TestFoo") {
+		t.Errorf("summary should contain the failure excerpt, got %q", out)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	client := newTestServer(t)
+	annotations, err := client.Organization("example").Pipeline("app").Build(2).Annotations(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotations) != 1 || annotations[0].Context != "test-summary" {
+		t.Errorf("unexpected annotations: %#v", annotations)
+	}
+}
+
+func TestAnnotationsQuery(t *testing.T) {
+	client := newTestServer(t)
+	build := client.Organization("example").Pipeline("app").Build(2)
+	annotations, err := build.Annotations(context.Background(), url.Values{"context": []string{"test-summary"}, "style": []string{"error"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotations) != 1 || annotations[0].Style != "error" {
+		t.Errorf("unexpected annotations: %#v", annotations)
+	}
+	annotations, err = build.Annotations(context.Background(), url.Values{"context": []string{"coverage"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(annotations) != 0 {
+		t.Errorf("expected no annotations for other context, got %#v", annotations)
+	}
+}
+
+func TestAnnotationFilter(t *testing.T) {
+	annotations := AnnotationResponse{
+		{Context: "test-summary", Style: "error"},
+		{Context: "test-summary", Style: "info"},
+		{Context: "coverage", Style: "info"},
+	}
+	tests := []struct {
+		context, style string
+		want           int
+	}{
+		{"", "", 3},
+		{"test-summary", "", 2},
+		{"", "info", 2},
+		{"coverage", "info", 1},
+		{"coverage", "error", 0},
+	}
+	for _, tt := range tests {
+		if got := annotations.Filter(tt.context, tt.style); len(got) != tt.want {
+			t.Errorf("Filter(%q, %q): got %d annotations, want %d", tt.context, tt.style, len(got), tt.want)
+		}
+	}
+}
+
+func TestAnnotationFailed(t *testing.T) {
+	annotations := AnnotationResponse{
+		{Context: "a", Style: "error"},
+		{Context: "b", Style: "info"},
+		{Context: "c", Style: "warning"},
+		{Context: "d", Style: "success"},
+	}
+	failed := annotations.Failed()
+	if len(failed) != 2 || failed[0].Context != "a" || failed[1].Context != "c" {
+		t.Errorf("unexpected failed annotations: %#v", failed)
+	}
+}
+
+func TestListPipelines(t *testing.T) {
+	client := newTestServer(t)
+	pipelines, err := client.Organization("example").ListPipelines(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pipelines) != 1 {
+		t.Fatalf("expected 1 pipeline, got %d", len(pipelines))
+	}
+	if p := pipelines[0]; p.Slug != "app" || p.Repository != "git@github.com:example/app.git" || p.RunningBuildsCount != 1 {
+		t.Errorf("unexpected pipeline: %#v", p)
+	}
+}
+
+func TestPipelineNotFound(t *testing.T) {
+	client := newTestServer(t)
+	_, err := client.Organization("example").Pipeline("missing").ListBuilds(context.Background(), nil)
+	if err == nil {
+		t.Fatal("expected an error for an unknown pipeline, got nil")
+	}
+	rerr, ok := err.(*resterror.Error)
+	if !ok {
+		t.Fatalf("expected a *resterror.Error, got %T", err)
+	}
+	if rerr.Status != 404 || rerr.Title != "No pipeline found" {
+		t.Errorf("unexpected error: %#v", rerr)
+	}
+}
+
+func TestJobEnv(t *testing.T) {
+	client := newTestServer(t)
+	env, err := client.Organization("example").Pipeline("app").Build(2).Job("job-failed").Env(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 2 || env["BUILDKITE_BRANCH"] != "main" {
+		t.Errorf("unexpected env: %v", env)
+	}
+}
+
+func TestCurrentUser(t *testing.T) {
+	client := newTestServer(t)
+	user, err := client.CurrentUser(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Example User" || user.Email != "user@example.com" {
+		t.Errorf("unexpected user: %#v", user)
+	}
+	orgs, err := client.ListOrganizations(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 1 || orgs[0].Slug != "example" {
+		t.Errorf("unexpected organizations: %#v", orgs)
+	}
+}
+
+func TestCurrentUserUnauthorized(t *testing.T) {
+	client := newTestServer(t)
+	client.Token = "bad-token"
+	_, err := client.CurrentUser(context.Background())
+	rerr, ok := err.(*resterror.Error)
+	if !ok {
+		t.Fatalf("expected a *resterror.Error, got %T (%v)", err, err)
+	}
+	if rerr.Status != 401 {
+		t.Errorf("expected a 401, got %d", rerr.Status)
+	}
+	if !strings.Contains(rerr.Error(), "api-access-tokens") {
+		t.Errorf("expected a hint about creating a token, got %q", rerr.Error())
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	client := newTestServer(t)
+	client.Token = "expired-token"
+	var calls int
+	client.RefreshToken = func() (string, error) {
+		calls++
+		return "test-token", nil
+	}
+	user, err := client.CurrentUser(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Example User" || calls != 1 {
+		t.Errorf("got user %q after %d refreshes", user.Name, calls)
+	}
+	if _, err := client.Organization("example").Pipeline("app").Build(2).Job("job-failed").RawLog(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("expected the refreshed token to be reused, got %d refreshes", calls)
+	}
+
+	// A refresh that returns another bad token is only tried once.
+	client.Token = "expired-token"
+	calls = 0
+	client.RefreshToken = func() (string, error) {
+		calls++
+		return fmt.Sprintf("still-bad-%d", calls), nil
+	}
+	_, err = client.CurrentUser(context.Background())
+	if rerr, ok := err.(*resterror.Error); !ok || rerr.Status != 401 {
+		t.Errorf("expected a 401, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 refresh, got %d", calls)
+	}
+}
+
+func TestRefreshAfterWrappedError(t *testing.T) {
+	client := NewClient("expired-token")
+	client.RefreshToken = func() (string, error) { return "new-token", nil }
+	err := fmt.Errorf("getting build: %w", &resterror.Error{Status: http.StatusUnauthorized, Title: "Unauthorized"})
+	if !client.refreshAfter(err, "expired-token") {
+		t.Error("expected a wrapped 401 to refresh the token")
+	}
+	if client.Token != "new-token" {
+		t.Errorf("expected the new token, got %q", client.Token)
+	}
+	err = fmt.Errorf("getting build: %w", &resterror.Error{Status: http.StatusNotFound})
+	if client.refreshAfter(err, "new-token") {
+		t.Error("expected a 404 not to refresh the token")
+	}
+}
+
+func TestRefreshTokenConcurrent(t *testing.T) {
+	// Hold the 401s until both requests have been sent with the expired
+	// token, so the second one fails after the first has refreshed it.
+	var expired sync.WaitGroup
+	expired.Add(2)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			expired.Done()
+			expired.Wait()
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message": "Authentication required"}`))
+			return
+		}
+		w.Write(userResponse)
+	}))
+	defer s.Close()
+	client := NewClientWithHTTPClient("expired-token", s.Client())
+	client.Base = s.URL
+	var calls atomic.Int32
+	client.RefreshToken = func() (string, error) {
+		calls.Add(1)
+		return "test-token", nil
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = client.CurrentUser(context.Background())
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("request %d: %v", i, err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 refresh, got %d", n)
 	}
-	out := FindBuildFailure(byteContent, 10)
-	fmt.Printf("output: %q\n", string(out))
-	fmt.Printf("output: %v\n", string(out))
-	t.Fail()
 }
 
 var commandTests = []struct {
@@ -47,8 +408,390 @@ func TestCommandRe(t *testing.T) {
 }
 
 func TestPullRequest(t *testing.T) {
-	p := PullRequest{ID: "421", Base: "main", Repository: "https://github.com/segmentio/integrations-consumer.git"}
-	if u := p.URL(); u != "https://github.com/segmentio/integrations-consumer/pull/421" {
-		t.Errorf("incorrect URL: got %q", u)
+	tests := []struct {
+		repo string
+		want string
+	}{
+		{"https://github.com/segmentio/integrations-consumer.git", "https://github.com/segmentio/integrations-consumer/pull/421"},
+		{"https://github.example.com/team/app.git", "https://github.example.com/team/app/pull/421"},
+		{"https://gitlab.com/team/app.git", "https://gitlab.com/team/app/-/merge_requests/421"},
+		{"https://gitlab.example.com/group/sub/app.git", "https://gitlab.example.com/group/sub/app/-/merge_requests/421"},
+		{"https://bitbucket.org/team/app.git", "https://bitbucket.org/team/app/pull-requests/421"},
+	}
+	for _, tt := range tests {
+		p := PullRequest{ID: "421", Base: "main", Repository: tt.repo}
+		if u := p.URL(); u != tt.want {
+			t.Errorf("URL for %q: got %q, want %q", tt.repo, u, tt.want)
+		}
+	}
+}
+
+func TestPullRequestProviderURL(t *testing.T) {
+	p := PullRequest{ID: "7", Repository: "https://code.example.com/team/app.git"}
+	if u := p.ProviderURL(GitLab); u != "https://code.example.com/team/app/-/merge_requests/7" {
+		t.Errorf("self-hosted GitLab: got %q", u)
+	}
+	if u := p.ProviderURL(""); u != "https://code.example.com/team/app/pull/7" {
+		t.Errorf("undetected host: got %q", u)
+	}
+	p.Repository = "https://gitlab.com/team/app.git"
+	if u := p.ProviderURL(""); u != "https://gitlab.com/team/app/-/merge_requests/7" {
+		t.Errorf("gitlab.com: got %q", u)
+	}
+}
+
+func TestDetectProvider(t *testing.T) {
+	tests := []struct {
+		host string
+		want Provider
+	}{
+		{"github.com", GitHub},
+		{"gitlab.com", GitLab},
+		{"GitLab.Example.com", GitLab},
+		{"bitbucket.org", Bitbucket},
+		{"git.example.com", GitHub},
+	}
+	for _, tt := range tests {
+		if got := DetectProvider(tt.host); got != tt.want {
+			t.Errorf("DetectProvider(%q): got %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestOrg(t *testing.T) {
+	cfg := &FileConfig{Organizations: map[string]Organization{
+		"Example": {Name: "Example", Token: "abc"},
+	}}
+	org, ok := cfg.Org("example")
+	if !ok {
+		t.Fatal("could not find org")
+	}
+	if org.Token != "abc" {
+		t.Errorf("wrong token: got %q", org.Token)
+	}
+	if _, ok := cfg.Org("other"); ok {
+		t.Error("found org that does not exist")
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	tests := []struct {
+		org     Organization
+		want    string
+		wantErr string
+	}{
+		{Organization{Name: "static", Token: "abc"}, "abc", ""},
+		{Organization{Name: "cmd", Token: "abc", TokenCommand: "echo '  from-command  '"}, "from-command", ""},
+		{Organization{Name: "fails", TokenCommand: "echo 'no such secret' >&2; exit 3"}, "", "no such secret"},
+		{Organization{Name: "empty", TokenCommand: "true"}, "", "empty token"},
+	}
+	for _, tt := range tests {
+		got, err := tt.org.APIToken()
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: expected error containing %q, got %v", tt.org.Name, tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.org.Name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got token %q, want %q", tt.org.Name, got, tt.want)
+		}
+	}
+	cfg := &FileConfig{Organizations: map[string]Organization{
+		"example": {Name: "example", TokenCommand: "echo secret", GitRemotes: []string{"example"}},
+	}}
+	if token, err := cfg.Token("example"); err != nil || token != "secret" {
+		t.Errorf("Token: got %q, %v; want secret", token, err)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	start := time.Date(2024, 7, 22, 17, 35, 0, 0, time.UTC)
+	b := Build{StartedAt: start}
+	b.FinishedAt.Valid = true
+	b.FinishedAt.Time = start.Add(5 * time.Minute)
+	if d := b.Duration(); d != 5*time.Minute {
+		t.Errorf("finished build: got duration %v, want 5m", d)
+	}
+	if b.Running() {
+		t.Error("finished build should not be running")
+	}
+
+	unfinished := Build{StartedAt: time.Now().Add(-3 * time.Minute)}
+	if d := unfinished.Duration(); d < 3*time.Minute || d > 4*time.Minute {
+		t.Errorf("unfinished build: got duration %v, want about 3m", d)
+	}
+	if !unfinished.Running() {
+		t.Error("unfinished build should be running")
+	}
+
+	var notStarted Build
+	if d := notStarted.Duration(); d != 0 {
+		t.Errorf("build that has not started: got duration %v, want 0", d)
+	}
+	if notStarted.Running() {
+		t.Error("build that has not started should not be running")
+	}
+
+	var job Job
+	if d := job.Duration(); d != 0 {
+		t.Errorf("job that has not started: got duration %v, want 0", d)
+	}
+	job.StartedAt = time.Now().Add(-time.Minute)
+	if d := job.Duration(); d < time.Minute || d > 2*time.Minute {
+		t.Errorf("running job: got duration %v, want about 1m", d)
+	}
+	job.FinishedAt.Valid = true
+	job.FinishedAt.Time = job.StartedAt.Add(10 * time.Second)
+	if d := job.Duration(); d != 10*time.Second {
+		t.Errorf("finished job: got duration %v, want 10s", d)
+	}
+}
+
+func TestBuildSummaryNotStarted(t *testing.T) {
+	client := NewClient("")
+	build := Build{
+		Number: 3,
+		State:  "scheduled",
+		Jobs: []Job{
+			{ID: "a", Name: "queued-job", State: "scheduled"},
+		},
+	}
+	out := string(client.BuildSummary(context.Background(), "example", "app", build, 10))
+	if !strings.Contains(out, "queued-job queued") {
+		t.Errorf("summary should report the job as queued, got %q", out)
+	}
+	if strings.Contains(out, "0s") {
+		t.Errorf("summary should not contain an elapsed time, got %q", out)
+	}
+}
+
+func TestBuildSummaryRetried(t *testing.T) {
+	client := NewClient("")
+	start := time.Date(2024, 7, 22, 17, 0, 0, 0, time.UTC)
+	job := func(id string, state JobState, retried bool) Job {
+		j := Job{ID: id, Name: "test", State: state, StartedAt: start, Retried: retried}
+		j.FinishedAt.Valid = true
+		j.FinishedAt.Time = start.Add(time.Minute)
+		return j
+	}
+	build := Build{Number: 3, State: "passed", Jobs: []Job{
+		job("a", "failed", true),
+		job("b", "passed", false),
+	}}
+	if failed := build.FailedJobs(); len(failed) != 0 {
+		t.Errorf("retried jobs should not count as failed, got %#v", failed)
+	}
+	out := string(client.BuildSummary(context.Background(), "example", "app", build, 10))
+	if !strings.Contains(out, "test (retried) 1m0s") {
+		t.Errorf("summary should label the retried attempt, got %q", out)
+	}
+	if strings.Count(out, "test") != 2 {
+		t.Errorf("summary should list both attempts, got %q", out)
+	}
+}
+
+func TestPipelineFor(t *testing.T) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		t.Skip("no home directory")
+	}
+	cfg := &FileConfig{Pipelines: map[string]string{
+		"github.com/example/app": "app-build",
+		"example/other":          "other-build",
+		"~/src/monorepo":         "monorepo",
+	}}
+	tests := []struct {
+		keys []string
+		want string
+		ok   bool
+	}{
+		{[]string{"/tmp/app", "github.com/example/app", "example/app"}, "app-build", true},
+		{[]string{"/tmp/other", "github.com/example/other", "example/other"}, "other-build", true},
+		{[]string{filepath.Join(home, "src", "monorepo"), "github.com/example/monorepo"}, "monorepo", true},
+		{[]string{"/tmp/unknown", "github.com/example/unknown"}, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := cfg.PipelineFor(tt.keys...)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("PipelineFor(%q): got (%q, %t), want (%q, %t)", tt.keys, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestJobWebURL(t *testing.T) {
+	job := Job{ID: "0190a0c3-0d6c-4e1f-9a1b-2f3c4d5e6f70"}
+	want := "https://buildkite.com/example/app/builds/5#0190a0c3-0d6c-4e1f-9a1b-2f3c4d5e6f70"
+	if got := job.WebURL("https://buildkite.com/example/app/builds/5"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDuplicateRemotes(t *testing.T) {
+	cfg := &FileConfig{Organizations: map[string]Organization{
+		"zeta":  {Name: "zeta", Token: "zeta-token", GitRemotes: []string{"shared", "zeta_gh"}},
+		"alpha": {Name: "alpha", Token: "alpha-token", GitRemotes: []string{"shared"}},
+		"beta":  {Name: "beta", Token: "beta-token", GitRemotes: []string{"beta_gh"}},
+	}}
+	dups := cfg.DuplicateRemotes()
+	if len(dups) != 1 || dups[0].Remote != "shared" || len(dups[0].Orgs) != 2 || dups[0].Orgs[0] != "alpha" || dups[0].Orgs[1] != "zeta" {
+		t.Fatalf("unexpected duplicates: %#v", dups)
+	}
+	// The first org by name always wins, whatever the map order.
+	for i := 0; i < 10; i++ {
+		org, ok := cfg.OrgForRemote("shared")
+		if !ok || org.Name != "alpha" {
+			t.Fatalf("expected alpha for the shared remote, got %q", org.Name)
+		}
+		token, err := cfg.Token("shared")
+		if err != nil || token != "alpha-token" {
+			t.Fatalf("expected alpha-token, got %q, %v", token, err)
+		}
+	}
+	if org, ok := cfg.OrgForRemote("zeta_gh"); !ok || org.Name != "zeta" {
+		t.Errorf("expected zeta for zeta_gh, got %q", org.Name)
+	}
+}
+
+func TestOrgForPipeline(t *testing.T) {
+	cfg := &FileConfig{
+		Organizations: map[string]Organization{
+			"example":    {Name: "example", GitRemotes: []string{"example_gh"}},
+			"kevinburke": {Name: "kevinburke"},
+		},
+		Pipelines: map[string]string{
+			"github.com/example_gh/app": "app-build",
+			"kevinburke/tool":           "tool-ci",
+			"~/src/monorepo":            "monorepo",
+		},
+	}
+	tests := []struct {
+		slug string
+		want string
+		ok   bool
+	}{
+		{"app-build", "example", true},
+		{"tool-ci", "kevinburke", true},
+		{"monorepo", "", false},
+		{"unknown", "", false},
+	}
+	for _, tt := range tests {
+		org, ok := cfg.OrgForPipeline(tt.slug)
+		if org.Name != tt.want || ok != tt.ok {
+			t.Errorf("OrgForPipeline(%q): got (%q, %t), want (%q, %t)", tt.slug, org.Name, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func exitStatus(n int) *int {
+	return &n
+}
+
+var failedTests = []struct {
+	state      JobState
+	exitStatus *int
+	want       bool
+}{
+	{"passed", nil, false},
+	{"passed", exitStatus(0), false},
+	{"running", nil, false},
+	{"scheduled", nil, false},
+	{"skipped", nil, false},
+	{"failed", exitStatus(1), true},
+	{"failed", nil, true},
+	{"broken", nil, true},
+	{"timed_out", nil, true},
+	{"canceled", nil, true},
+	{"finished", exitStatus(0), false},
+	{"finished", exitStatus(2), true},
+	{"finished", exitStatus(-1), true},
+}
+
+func TestJobFailed(t *testing.T) {
+	for _, tt := range failedTests {
+		job := Job{State: tt.state, ExitStatus: tt.exitStatus}
+		if got := job.Failed(); got != tt.want {
+			status := "nil"
+			if tt.exitStatus != nil {
+				status = strconv.Itoa(*tt.exitStatus)
+			}
+			t.Errorf("Job{State: %q, ExitStatus: %s}.Failed(): got %t, want %t", tt.state, status, got, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalExitStatus(t *testing.T) {
+	var job Job
+	if err := json.Unmarshal([]byte(`{"state": "finished", "exit_status": 1}`), &job); err != nil {
+		t.Fatal(err)
+	}
+	if job.ExitStatus == nil || *job.ExitStatus != 1 {
+		t.Errorf("expected exit status 1, got %v", job.ExitStatus)
+	}
+	if !job.Failed() {
+		t.Error("job with a non-zero exit status should have failed")
+	}
+}
+
+func TestFailedAndRunningJobs(t *testing.T) {
+	b := Build{Jobs: []Job{
+		{ID: "1", State: "passed"},
+		{ID: "2", State: "timed_out"},
+		{ID: "3", State: "running"},
+		{ID: "4", State: "broken"},
+		{ID: "5", State: "failed"},
+	}}
+	failed := b.FailedJobs()
+	if len(failed) != 3 || failed[0].ID != "2" || failed[1].ID != "4" || failed[2].ID != "5" {
+		t.Errorf("unexpected failed jobs: %#v", failed)
+	}
+	running := b.RunningJobs()
+	if len(running) != 1 || running[0].ID != "3" {
+		t.Errorf("unexpected running jobs: %#v", running)
+	}
+}
+
+func TestTriggeredBuilds(t *testing.T) {
+	var build Build
+	if err := json.Unmarshal([]byte(`{"number": 3, "jobs": [
+		{"id": "a", "type": "script", "name": "test"},
+		{"id": "b", "type": "trigger", "name": "deploy", "triggered_build": {
+			"id": "f00", "number": 12,
+			"url": "https://api.buildkite.com/v2/organizations/example/pipelines/deploy/builds/12",
+			"web_url": "https://buildkite.com/example/deploy/builds/12"}},
+		{"id": "c", "type": "trigger", "name": "not started yet"}
+	]}`), &build); err != nil {
+		t.Fatal(err)
+	}
+	triggered := build.TriggeredBuilds()
+	if len(triggered) != 1 || triggered[0].Number != 12 {
+		t.Fatalf("unexpected triggered builds: %#v", triggered)
+	}
+	org, slug, ok := triggered[0].Pipeline()
+	if !ok || org != "example" || slug != "deploy" {
+		t.Errorf("Pipeline(): got %q, %q, %t", org, slug, ok)
+	}
+}
+
+func TestTriggeredBuildPipeline(t *testing.T) {
+	tests := []struct {
+		build     TriggeredBuild
+		org, slug string
+		ok        bool
+	}{
+		{TriggeredBuild{URL: "https://api.buildkite.com/v2/organizations/example/pipelines/app/builds/5"}, "example", "app", true},
+		{TriggeredBuild{WebURL: "https://buildkite.com/example/app/builds/5"}, "example", "app", true},
+		{TriggeredBuild{URL: "https://example.com/", WebURL: "https://example.com/foo"}, "", "", false},
+		{TriggeredBuild{}, "", "", false},
+	}
+	for _, tt := range tests {
+		org, slug, ok := tt.build.Pipeline()
+		if org != tt.org || slug != tt.slug || ok != tt.ok {
+			t.Errorf("%#v: got %q, %q, %t; want %q, %q, %t", tt.build, org, slug, ok, tt.org, tt.slug, tt.ok)
+		}
 	}
 }
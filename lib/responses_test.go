@@ -4200,6 +4200,9 @@ func TestJSONUnmarshal(t *testing.T) {
 		if len(builds) != 3 {
 			t.Errorf("should have gotten 3 builds, got %d", len(builds))
 		}
+		if builds[0].Source != "webhook" || builds[0].Creator != nil {
+			t.Errorf("unexpected source/creator: %q, %v", builds[0].Source, builds[0].Creator)
+		}
 	})
 	t.Run("Log", func(t *testing.T) {
 		var log Log
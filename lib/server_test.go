@@ -0,0 +1,193 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Fixtures served by the fake Buildkite server. The org is "example" and the
+// pipeline is "app"; build 1 passed and build 2 failed.
+var passedBuildResponse = []byte(`{
+  "id": "0190db82-b02b-44d4-a3b7-2b7b04925ada",
+  "web_url": "https://buildkite.com/example/app/builds/1",
+  "number": 1,
+  "state": "passed",
+  "branch": "main",
+  "commit": "8a7616c30d55587cc6aaa20ec01e06b2e085374a",
+  "message": "Add a feature",
+  "created_at": "2024-07-22T17:34:53.501Z",
+  "scheduled_at": "2024-07-22T17:34:53.449Z",
+  "started_at": "2024-07-22T17:35:03.886Z",
+  "finished_at": "2024-07-22T17:39:58.132Z",
+  "pipeline": {"slug": "app", "name": "app"},
+  "jobs": [
+    {
+      "id": "job-passed",
+      "type": "script",
+      "name": "test",
+      "state": "passed",
+      "created_at": "2024-07-22T17:34:53.501Z",
+      "started_at": "2024-07-22T17:35:03.886Z",
+      "finished_at": "2024-07-22T17:39:58.132Z"
+    }
+  ]
+}`)
+
+var failedBuildResponse = []byte(`{
+  "id": "0190db82-b02b-44d4-a3b7-2b7b04925adb",
+  "web_url": "https://buildkite.com/example/app/builds/2",
+  "number": 2,
+  "state": "failed",
+  "branch": "main",
+  "commit": "4416ce9a1bbd38505c72f8f9d034a45c41b02a02",
+  "message": "Break the tests",
+  "created_at": "2024-07-22T18:34:53.501Z",
+  "scheduled_at": "2024-07-22T18:34:53.449Z",
+  "started_at": "2024-07-22T18:35:03.886Z",
+  "finished_at": "2024-07-22T18:39:58.132Z",
+  "pipeline": {"slug": "app", "name": "app"},
+  "jobs": [
+    {
+      "id": "job-lint",
+      "type": "script",
+      "name": "lint",
+      "state": "passed",
+      "created_at": "2024-07-22T18:34:53.501Z",
+      "started_at": "2024-07-22T18:35:03.886Z",
+      "finished_at": "2024-07-22T18:36:03.886Z"
+    },
+    {
+      "id": "job-failed",
+      "type": "script",
+      "name": "test",
+      "state": "failed",
+      "created_at": "2024-07-22T18:34:53.501Z",
+      "started_at": "2024-07-22T18:35:03.886Z",
+      "finished_at": "2024-07-22T18:39:58.132Z"
+    }
+  ]
+}`)
+
+var failedJobLog = []byte("~~~ Running global pre-command hook\n" +
+	"setting up\n" +
+	"~~~ Running commands\n" +
+	"go test ./...\n" +
+	"--- FAIL: TestFoo (0.00s)\n" +
+	"FAIL\n" +
+	"~~~ Running global post-command hook\n" +
+	"cleaning up\n")
+
+var annotationsResponse = []byte(`[
+  {
+    "id": "de0d4ab5-6360-467a-a34b-e5ef5db5320d",
+    "context": "test-summary",
+    "style": "error",
+    "body_html": "<p>1 test failed</p>",
+    "created_at": "2024-07-22T18:39:58.132Z",
+    "updated_at": "2024-07-22T18:39:58.132Z"
+  }
+]`)
+
+var pipelinesResponse = []byte(`[
+  {
+    "id": "ab207a7b-48ad-4c39-9cb7-98670e2ab989",
+    "name": "app",
+    "slug": "app",
+    "repository": "git@github.com:example/app.git",
+    "web_url": "https://buildkite.com/example/app",
+    "default_branch": "main",
+    "running_builds_count": 1,
+    "scheduled_builds_count": 0
+  }
+]`)
+
+var userResponse = []byte(`{
+  "id": "52ddcfda-658f-404a-b2d2-b006f3c7a2ad",
+  "name": "Example User",
+  "email": "user@example.com",
+  "avatar_url": "https://www.gravatar.com/avatar/example",
+  "created_at": "2020-01-02T03:04:05.000Z"
+}`)
+
+var organizationsResponse = []byte(`[
+  {
+    "id": "a1b2c3d4-0000-4000-8000-000000000000",
+    "slug": "example",
+    "name": "Example",
+    "web_url": "https://buildkite.com/example",
+    "created_at": "2020-01-02T03:04:05.000Z"
+  }
+]`)
+
+// newTestServer starts a fake Buildkite API serving the fixtures above, and
+// returns a Client that makes requests against it. Requests for any other
+// path, for example an unknown pipeline, get a 404.
+func newTestServer(t *testing.T) *Client {
+	t.Helper()
+	const prefix = "/v2/organizations/example/pipelines/app"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"message":"Authentication required. Please supply a valid API Access Token"}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/user":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(userResponse)
+		case "/v2/organizations":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(organizationsResponse)
+		case "/v2/organizations/example/pipelines":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(pipelinesResponse)
+		case prefix + "/builds":
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Query().Get("commit") {
+			case "":
+				w.Write(buildsResponse)
+			case "8a7616c30d55587cc6aaa20ec01e06b2e085374a":
+				w.Write([]byte("[" + string(passedBuildResponse) + "]"))
+			case "4416ce9a1bbd38505c72f8f9d034a45c41b02a02":
+				w.Write([]byte("[" + string(failedBuildResponse) + "]"))
+			default:
+				w.Write([]byte("[]"))
+			}
+		case prefix + "/builds/1":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(passedBuildResponse)
+		case prefix + "/builds/2":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(failedBuildResponse)
+		case prefix + "/builds/2/jobs/job-failed/env":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"env": {"BUILDKITE_BRANCH": "main", "CI": "true"}}`))
+		case prefix + "/builds/2/jobs/job-failed/log":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(failedJobLog)
+		case prefix + "/builds/1/annotations", prefix + "/builds/2/annotations":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(annotationsResponse)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No pipeline found"}`))
+		}
+	}))
+	t.Cleanup(s.Close)
+	client := NewClientWithHTTPClient("test-token", s.Client())
+	client.Base = s.URL
+	return client
+}
+
+func TestFixtures(t *testing.T) {
+	for _, data := range [][]byte{passedBuildResponse, failedBuildResponse} {
+		var build Build
+		if err := json.Unmarshal(data, &build); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	types "github.com/kevinburke/go-types"
+)
+
+// timestampLayouts are the formats accepted for timestamps in API responses,
+// tried in order. Fractional seconds are accepted after the seconds in each
+// layout, whether or not the layout has them.
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 Z07:00",
+	"2006-01-02 15:04:05 MST",
+}
+
+// parseTimestamp parses a timestamp from the Buildkite API. Most timestamps
+// are RFC 3339 with millisecond precision, but some endpoints omit the
+// fractional seconds, use a numeric offset without a colon, or use a space
+// instead of a "T". Timestamps with no zone are assumed to be UTC.
+func parseTimestamp(s string) (time.Time, error) {
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("buildkite: cannot parse timestamp %q", s)
+}
+
+// apiTime decodes a timestamp using parseTimestamp. null and the empty string
+// decode to an invalid (zero) time.
+type apiTime struct {
+	t     time.Time
+	valid bool
+}
+
+func (a *apiTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*a = apiTime{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		*a = apiTime{}
+		return nil
+	}
+	t, err := parseTimestamp(s)
+	if err != nil {
+		return err
+	}
+	*a = apiTime{t: t, valid: true}
+	return nil
+}
+
+func (a apiTime) nullTime() types.NullTime {
+	return types.NullTime{Time: a.t, Valid: a.valid}
+}
+
+func (b *Build) UnmarshalJSON(data []byte) error {
+	type buildAlias Build
+	aux := struct {
+		*buildAlias
+		// These shadow the fields of the same name on the embedded type.
+		CreatedAt   apiTime `json:"created_at"`
+		StartedAt   apiTime `json:"started_at"`
+		ScheduledAt apiTime `json:"scheduled_at"`
+		FinishedAt  apiTime `json:"finished_at"`
+	}{buildAlias: (*buildAlias)(b)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	b.CreatedAt = aux.CreatedAt.t
+	b.StartedAt = aux.StartedAt.t
+	b.ScheduledAt = aux.ScheduledAt.nullTime()
+	b.FinishedAt = aux.FinishedAt.nullTime()
+	return nil
+}
+
+func (j *Job) UnmarshalJSON(data []byte) error {
+	type jobAlias Job
+	aux := struct {
+		*jobAlias
+		// These shadow the fields of the same name on the embedded type.
+		CreatedAt   apiTime `json:"created_at"`
+		StartedAt   apiTime `json:"started_at"`
+		ScheduledAt apiTime `json:"scheduled_at"`
+		FinishedAt  apiTime `json:"finished_at"`
+	}{jobAlias: (*jobAlias)(j)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	j.CreatedAt = aux.CreatedAt.t
+	j.StartedAt = aux.StartedAt.t
+	j.ScheduledAt = aux.ScheduledAt.nullTime()
+	j.FinishedAt = aux.FinishedAt.nullTime()
+	return nil
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2024, 7, 22, 17, 35, 3, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"2024-07-22T17:35:03Z", want},
+		{"2024-07-22T17:35:03.886Z", want.Add(886 * time.Millisecond)},
+		{"2024-07-22T17:35:03.886123Z", want.Add(886123 * time.Microsecond)},
+		{"2024-07-22T10:35:03-07:00", want},
+		{"2024-07-22T10:35:03.5-07:00", want.Add(500 * time.Millisecond)},
+		{"2024-07-22T10:35:03-0700", want},
+		{"2024-07-22 17:35:03Z", want},
+		{"2024-07-22 10:35:03 -0700", want},
+		{"2024-07-22 17:35:03 UTC", want},
+		{"2024-07-22T17:35:03", want},
+		{"2024-07-22 17:35:03.886", want.Add(886 * time.Millisecond)},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.in)
+		if err != nil {
+			t.Errorf("parseTimestamp(%q): %v", tt.in, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseTimestamp(%q): got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{"yesterday", "2024-07-22", "17:35:03"} {
+		if _, err := parseTimestamp(in); err == nil {
+			t.Errorf("parseTimestamp(%q): expected an error", in)
+		}
+	}
+}
+
+func TestUnmarshalTimestamps(t *testing.T) {
+	var builds []Build
+	if err := json.Unmarshal(buildsResponse, &builds); err != nil {
+		t.Fatal(err)
+	}
+	b := builds[0]
+	if want := time.Date(2024, 7, 22, 17, 35, 3, 886000000, time.UTC); !b.StartedAt.Equal(want) {
+		t.Errorf("StartedAt: got %v, want %v", b.StartedAt, want)
+	}
+	if !b.FinishedAt.Valid || b.Duration() != 4*time.Minute+54*time.Second+246*time.Millisecond {
+		t.Errorf("unexpected FinishedAt %v / duration %v", b.FinishedAt, b.Duration())
+	}
+	if b.Number != 50302 || len(b.Jobs) == 0 || b.Pipeline.Slug == "" {
+		t.Errorf("other fields were not decoded: %#v", b)
+	}
+	if b.Jobs[0].CreatedAt.IsZero() {
+		t.Errorf("job timestamps were not decoded: %#v", b.Jobs[0])
+	}
+
+	// The same build with the timestamps in other formats Buildkite uses.
+	data := string(buildsResponse)
+	data = strings.Replace(data, `"started_at": "2024-07-22T17:35:03.886Z"`, `"started_at": "2024-07-22T10:35:03-0700"`, 1)
+	data = strings.Replace(data, `"finished_at": "2024-07-22T17:39:58.132Z"`, `"finished_at": "2024-07-22 17:39:58Z"`, 1)
+	data = strings.Replace(data, `"scheduled_at": "2024-07-22T17:34:53.449Z"`, `"scheduled_at": ""`, 1)
+	var variants []Build
+	if err := json.Unmarshal([]byte(data), &variants); err != nil {
+		t.Fatal(err)
+	}
+	v := variants[0]
+	if want := time.Date(2024, 7, 22, 17, 35, 3, 0, time.UTC); !v.StartedAt.Equal(want) {
+		t.Errorf("StartedAt: got %v, want %v", v.StartedAt, want)
+	}
+	if want := time.Date(2024, 7, 22, 17, 39, 58, 0, time.UTC); !v.FinishedAt.Valid || !v.FinishedAt.Time.Equal(want) {
+		t.Errorf("FinishedAt: got %v, want %v", v.FinishedAt, want)
+	}
+	if v.ScheduledAt.Valid {
+		t.Errorf("expected an empty scheduled_at to be invalid, got %v", v.ScheduledAt)
+	}
+
+	var job Job
+	if err := json.Unmarshal([]byte(`{"id": "a", "started_at": null, "finished_at": null, "created_at": "2024-07-22T17:34:53Z"}`), &job); err != nil {
+		t.Fatal(err)
+	}
+	if !job.StartedAt.IsZero() || job.FinishedAt.Valid || job.CreatedAt.IsZero() {
+		t.Errorf("unexpected job timestamps: %#v", job)
+	}
+	if err := json.Unmarshal([]byte(`{"id": "a", "started_at": "soon"}`), &job); err == nil {
+		t.Error("expected an error for an invalid timestamp")
+	}
+}
@@ -0,0 +1,357 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrNoBuilds is returned when a pipeline has no builds on a branch.
+var ErrNoBuilds = errors.New("buildkite: no builds")
+
+// IsNetworkError checks if the given error is a request timeout or a network
+// failure - in those cases we want to just retry the request. Connections that
+// are reset or closed partway through a response, which flaky proxies do, count
+// as network failures, including when reading the body fails with a bare
+// io.ErrUnexpectedEOF. Bodies are decoded with json.Unmarshal, so an empty or
+// truncated JSON body is a *json.SyntaxError, which is not retried.
+func IsNetworkError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	// some net.OpError's are wrapped in a url.Error
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	switch err := err.(type) {
+	default:
+		return false
+	case *net.OpError:
+		return err.Op == "dial" && err.Net == "tcp"
+	case *net.DNSError:
+		return true
+	// Catchall, this needs to go last.
+	case net.Error:
+		return err.Timeout()
+	}
+}
+
+// Events that don't correspond to a build state; see WaitEvent.
+const (
+	// No build of the commit has appeared yet.
+	EventWaitingForCommit = "waiting_for_commit"
+	// A request failed with a network error, and will be retried.
+	EventNetworkError = "network_error"
+	// Waiting failed before the build finished.
+	EventError = "error"
+)
+
+// WaitEvent describes the progress of a build that's being waited for, for
+// tools that want to show their own progress. "buildkite wait -json-stream"
+// prints one per line.
+type WaitEvent struct {
+	// The build's state, e.g. "running" or "passed", or one of the Event*
+	// constants.
+	Event  string `json:"event"`
+	Build  int64  `json:"build,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// Seconds since the build started, or since waiting started if there's
+	// no build yet.
+	Elapsed float64 `json:"elapsed"`
+	URL     string  `json:"url,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	// Set on the last event, which is always sent, however waiting ends.
+	Final bool `json:"final,omitempty"`
+}
+
+// NewWaitEvent returns an event for build's state at now.
+func NewWaitEvent(build Build, now time.Time) WaitEvent {
+	return WaitEvent{
+		Event:   string(build.State),
+		Build:   build.Number,
+		Branch:  build.Branch,
+		Commit:  build.Commit,
+		Elapsed: build.DurationAt(now).Round(time.Second).Seconds(),
+		URL:     build.WebURL,
+	}
+}
+
+// WaitOptions configures WaitForBuild. The zero value is ready to use.
+type WaitOptions struct {
+	// How often to check the state of the build. Defaults to 3 seconds.
+	Interval time.Duration
+	// How often to check for a build of the commit, while the latest build on
+	// the branch is for a different commit. Defaults to 5 seconds.
+	CommitInterval time.Duration
+
+	// OnProgress, if set, is called each time WaitForBuild finds that the
+	// build has not finished yet.
+	OnProgress func(build Build)
+	// OnWaitingForCommit, if set, is called each time the latest build on
+	// the branch is for a different commit than the one we are waiting for.
+	OnWaitingForCommit func(latest Build)
+	// OnNetworkError, if set, is called when a request fails with a network
+	// error, or because Buildkite is down, before it is retried.
+	OnNetworkError func(err error)
+	// MaxNetworkRetries is how many network errors in a row to retry before
+	// giving up and returning the error. Zero means retry forever.
+	MaxNetworkRetries int
+
+	// Clock is used to wait between checks. Defaults to RealClock; tests can
+	// set it to avoid sleeping.
+	Clock Clock
+}
+
+// Clock tells the time and waits for time to pass.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// RealClock is a Clock that uses the system time.
+var RealClock Clock = realClock{}
+
+func (o *WaitOptions) clock() Clock {
+	if o.Clock != nil {
+		return o.Clock
+	}
+	return RealClock
+}
+
+func (o *WaitOptions) interval() time.Duration {
+	if o.Interval > 0 {
+		return o.Interval
+	}
+	return 3 * time.Second
+}
+
+func (o *WaitOptions) commitInterval() time.Duration {
+	if o.CommitInterval > 0 {
+		return o.CommitInterval
+	}
+	return 5 * time.Second
+}
+
+// Done reports whether the build has reached a state where waiting longer
+// won't change the result. "failing" builds are done, since at least one job
+// has already failed.
+func (b Build) Done() bool {
+	switch b.State {
+	case "passed", "failed", "failing", "canceled", "skipped", "not_run":
+		return true
+	default:
+		return false
+	}
+}
+
+// Blocked reports whether the build is paused at a block step, waiting for
+// someone to unblock it.
+func (b Build) Blocked() bool {
+	return b.State == "blocked"
+}
+
+// retry handles a request that failed with err, the failures'th failure in a
+// row. Network errors, and responses saying Buildkite is down (see
+// IsUnavailable), are retried after a short sleep, until there have been more
+// than MaxNetworkRetries of them in a row; retry returns nil if the
+// request should be retried, and otherwise the error to return.
+func (o *WaitOptions) retry(ctx context.Context, err error, failures int) error {
+	if !IsNetworkError(err) && !IsUnavailable(err) {
+		return err
+	}
+	if o.MaxNetworkRetries > 0 && failures > o.MaxNetworkRetries {
+		return fmt.Errorf("buildkite: giving up after %d network errors in a row: %w", failures, err)
+	}
+	if o.OnNetworkError != nil {
+		o.OnNetworkError(err)
+	}
+	return sleep(ctx, o.clock(), 2*time.Second)
+}
+
+// sleep waits for d to pass on clock, or until ctx is canceled.
+func sleep(ctx context.Context, clock Clock, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-clock.After(d):
+		return nil
+	}
+}
+
+// LatestBuild returns the most recent build of the pipeline on branch, or
+// ErrNoBuilds if there are none.
+func (p *PipelineService) LatestBuild(ctx context.Context, branch string) (Build, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	builds, err := p.ListBuilds(ctx, url.Values{
+		"per_page": []string{"1"},
+		"branch":   []string{branch},
+	})
+	if err != nil {
+		return Build{}, err
+	}
+	if len(builds) == 0 {
+		return Build{}, ErrNoBuilds
+	}
+	return builds[0], nil
+}
+
+// BuildsForCommit returns the pipeline's builds of commit, on any branch, most
+// recent first. There can be more than one, for example if a build was
+// rebuilt. commit must be a full SHA.
+func (p *PipelineService) BuildsForCommit(ctx context.Context, commit string) ([]Build, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return p.ListBuilds(ctx, url.Values{
+		"per_page": []string{"100"},
+		"commit":   []string{commit},
+	})
+}
+
+// latestBuildOfCommit returns the most recent build of commit on branch, or
+// ErrNoBuilds if there are none.
+func (p *PipelineService) latestBuildOfCommit(ctx context.Context, branch, commit string) (Build, error) {
+	builds, err := p.BuildsForCommit(ctx, commit)
+	if err != nil {
+		return Build{}, err
+	}
+	for _, build := range builds {
+		if build.Branch == branch {
+			return build, nil
+		}
+	}
+	return Build{}, ErrNoBuilds
+}
+
+// LatestBuildForCommit returns the most recent build of commit in the
+// pipeline, on any branch, or ErrNoBuilds if there are none. commit must be a
+// full SHA.
+func (p *PipelineService) LatestBuildForCommit(ctx context.Context, commit string) (Build, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	// Search the whole organization, since that's where Buildkite indexes
+	// builds by commit, then pick out this pipeline's builds.
+	builds, err := p.client.Organization(p.org).ListBuilds(ctx, url.Values{
+		"per_page": []string{"100"},
+		"commit":   []string{commit},
+	})
+	if err != nil {
+		return Build{}, err
+	}
+	for _, build := range builds {
+		if build.Pipeline.Slug == p.pipeline {
+			return build, nil
+		}
+	}
+	return Build{}, ErrNoBuilds
+}
+
+// WaitForBuild waits for the latest build of commit on branch to finish, and
+// returns it. If commit is empty, WaitForBuild waits for the latest build on
+// the branch, whatever its commit. If branch is empty, WaitForBuild waits for
+// the latest build of commit on any branch, and returns ErrNoBuilds if there
+// isn't one. Blocked builds are returned too, since they won't finish until
+// someone unblocks them. Network errors are retried until ctx is canceled, or
+// opts.MaxNetworkRetries is reached. opts may be nil.
+func (c *Client) WaitForBuild(ctx context.Context, org, slug, branch, commit string, opts *WaitOptions) (Build, error) {
+	if opts == nil {
+		opts = new(WaitOptions)
+	}
+	if branch == "" && commit == "" {
+		return Build{}, errors.New("buildkite: WaitForBuild needs a branch or a commit")
+	}
+	pipeline := c.Organization(org).Pipeline(slug)
+	// The number of network errors in a row.
+	var failures int
+	for {
+		var build Build
+		var err error
+		switch {
+		case branch == "":
+			build, err = pipeline.LatestBuildForCommit(ctx, commit)
+		case commit != "":
+			// Look up the commit's builds directly, instead of checking the
+			// latest build on the branch, so we find the build even if newer
+			// commits have been pushed since.
+			build, err = pipeline.latestBuildOfCommit(ctx, branch, commit)
+			if err == ErrNoBuilds {
+				build, err = pipeline.LatestBuild(ctx, branch)
+			}
+		default:
+			build, err = pipeline.LatestBuild(ctx, branch)
+		}
+		if err != nil {
+			failures++
+			if err := opts.retry(ctx, err, failures); err != nil {
+				return Build{}, err
+			}
+			continue
+		}
+		failures = 0
+		if commit != "" && build.Commit != commit {
+			if opts.OnWaitingForCommit != nil {
+				opts.OnWaitingForCommit(build)
+			}
+			if err := sleep(ctx, opts.clock(), opts.commitInterval()); err != nil {
+				return Build{}, err
+			}
+			continue
+		}
+		if build.Done() || build.Blocked() {
+			return build, nil
+		}
+		if opts.OnProgress != nil {
+			opts.OnProgress(build)
+		}
+		if err := sleep(ctx, opts.clock(), opts.interval()); err != nil {
+			return Build{}, err
+		}
+	}
+}
+
+// Wait waits for the build to finish or be blocked, and returns it. Network
+// errors are retried as in WaitForBuild. opts may be nil; CommitInterval and
+// OnWaitingForCommit are not used.
+func (b *BuildService) Wait(ctx context.Context, opts *WaitOptions) (Build, error) {
+	if opts == nil {
+		opts = new(WaitOptions)
+	}
+	// The number of network errors in a row.
+	var failures int
+	for {
+		getCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		build, err := b.Get(getCtx, nil)
+		cancel()
+		if err != nil {
+			failures++
+			if err := opts.retry(ctx, err, failures); err != nil {
+				return Build{}, err
+			}
+			continue
+		}
+		failures = 0
+		if build.Done() || build.Blocked() {
+			return build, nil
+		}
+		if opts.OnProgress != nil {
+			opts.OnProgress(build)
+		}
+		if err := sleep(ctx, opts.clock(), opts.interval()); err != nil {
+			return Build{}, err
+		}
+	}
+}
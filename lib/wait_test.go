@@ -0,0 +1,383 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newSequenceServer returns a Client whose build list requests get each of
+// responses in turn; once they run out, the last one is repeated. Requests
+// filtered by commit get the matching builds from the current response, and
+// only move on to the next response if there are some, since otherwise
+// WaitForBuild asks for the latest build on the branch next.
+func newSequenceServer(t *testing.T, responses ...string) *Client {
+	t.Helper()
+	i := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/organizations/example/pipelines/app/builds" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		response := responses[i]
+		if commit := r.URL.Query().Get("commit"); commit != "" {
+			var builds []Build
+			if err := json.Unmarshal([]byte(response), &builds); err != nil {
+				t.Fatal(err)
+			}
+			var matches []Build
+			for _, build := range builds {
+				if build.Commit == commit {
+					build.Branch = "main"
+					matches = append(matches, build)
+				}
+			}
+			if len(matches) == 0 {
+				w.Write([]byte("[]"))
+				return
+			}
+			data, _ := json.Marshal(matches)
+			response = string(data)
+		} else if branch := r.URL.Query().Get("branch"); branch != "main" {
+			t.Errorf("expected branch=main, got %q", branch)
+		}
+		w.Write([]byte(response))
+		if i < len(responses)-1 {
+			i++
+		}
+	}))
+	t.Cleanup(s.Close)
+	client := NewClientWithHTTPClient("test-token", s.Client())
+	client.Base = s.URL
+	return client
+}
+
+var fastWait = WaitOptions{Interval: time.Millisecond, CommitInterval: time.Millisecond}
+
+func TestWaitForBuild(t *testing.T) {
+	client := newSequenceServer(t,
+		`[{"number": 4, "state": "running", "commit": "old"}]`,
+		`[{"number": 5, "state": "scheduled", "commit": "abc"}]`,
+		`[{"number": 5, "state": "running", "commit": "abc"}]`,
+		`[{"number": 5, "state": "passed", "commit": "abc"}]`,
+	)
+	opts := fastWait
+	var progress []BuildState
+	var waitedForCommit int
+	opts.OnProgress = func(b Build) { progress = append(progress, b.State) }
+	opts.OnWaitingForCommit = func(b Build) {
+		waitedForCommit++
+		if b.Commit != "old" {
+			t.Errorf("expected latest build for commit old, got %q", b.Commit)
+		}
+	}
+	build, err := client.WaitForBuild(context.Background(), "example", "app", "main", "abc", &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Number != 5 || build.State != "passed" {
+		t.Errorf("expected build 5 to pass, got build %d (%s)", build.Number, build.State)
+	}
+	if waitedForCommit != 1 {
+		t.Errorf("expected to wait for the commit once, got %d", waitedForCommit)
+	}
+	if len(progress) != 2 || progress[0] != "scheduled" || progress[1] != "running" {
+		t.Errorf("unexpected progress calls: %v", progress)
+	}
+}
+
+func TestWaitForBuildFailing(t *testing.T) {
+	client := newSequenceServer(t, `[{"number": 5, "state": "failing", "commit": "abc"}]`)
+	// A nil opts should work too; the build is already done so we never sleep.
+	build, err := client.WaitForBuild(context.Background(), "example", "app", "main", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.State != "failing" {
+		t.Errorf("expected failing build, got %q", build.State)
+	}
+}
+
+func TestWaitForBuildNoBuilds(t *testing.T) {
+	client := newSequenceServer(t, `[]`)
+	_, err := client.WaitForBuild(context.Background(), "example", "app", "main", "abc", &fastWait)
+	if err != ErrNoBuilds {
+		t.Errorf("expected ErrNoBuilds, got %v", err)
+	}
+}
+
+func TestWaitForBuildCanceled(t *testing.T) {
+	client := newSequenceServer(t, `[{"number": 5, "state": "running", "commit": "abc"}]`)
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := fastWait
+	opts.OnProgress = func(Build) { cancel() }
+	_, err := client.WaitForBuild(ctx, "example", "app", "main", "abc", &opts)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestWaitForBuildBlocked(t *testing.T) {
+	client := newSequenceServer(t,
+		`[{"number": 5, "state": "running", "commit": "abc"}]`,
+		`[{"number": 5, "state": "blocked", "commit": "abc", "jobs": [{"id": "1", "type": "manual", "label": "Deploy?", "state": "blocked"}]}]`,
+	)
+	build, err := client.WaitForBuild(context.Background(), "example", "app", "main", "", &fastWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !build.Blocked() {
+		t.Fatalf("expected blocked build, got %q", build.State)
+	}
+	if jobs := build.BlockedJobs(); len(jobs) != 1 || jobs[0].Label != "Deploy?" {
+		t.Errorf("unexpected blocked jobs: %#v", jobs)
+	}
+}
+
+func TestBuildWait(t *testing.T) {
+	responses := []string{
+		`{"number": 12, "state": "scheduled"}`,
+		`{"number": 12, "state": "running"}`,
+		`{"number": 12, "state": "passed"}`,
+	}
+	i := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/organizations/example/pipelines/deploy/builds/12" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(responses[i]))
+		if i < len(responses)-1 {
+			i++
+		}
+	}))
+	defer s.Close()
+	client := NewClientWithHTTPClient("test-token", s.Client())
+	client.Base = s.URL
+	opts := fastWait
+	var progress int
+	opts.OnProgress = func(Build) { progress++ }
+	build, err := client.Organization("example").Pipeline("deploy").Build(12).Wait(context.Background(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.State != "passed" {
+		t.Errorf("expected passed build, got %q", build.State)
+	}
+	if progress != 2 {
+		t.Errorf("expected 2 progress calls, got %d", progress)
+	}
+}
+
+func TestWaitForBuildAnyBranch(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/organizations/example/builds" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch commit := r.URL.Query().Get("commit"); commit {
+		case "abc":
+			w.Write([]byte(`[
+				{"number": 9, "state": "passed", "commit": "abc", "branch": "main", "pipeline": {"slug": "docs"}},
+				{"number": 5, "state": "failed", "commit": "abc", "branch": "feature", "pipeline": {"slug": "app"}}
+			]`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer s.Close()
+	client := NewClientWithHTTPClient("test-token", s.Client())
+	client.Base = s.URL
+	build, err := client.WaitForBuild(context.Background(), "example", "app", "", "abc", &fastWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Number != 5 || build.Branch != "feature" {
+		t.Errorf("expected build 5 on feature, got build %d on %q", build.Number, build.Branch)
+	}
+	_, err = client.WaitForBuild(context.Background(), "example", "app", "", "def", &fastWait)
+	if err != ErrNoBuilds {
+		t.Errorf("expected ErrNoBuilds, got %v", err)
+	}
+}
+
+func TestBuildsForCommit(t *testing.T) {
+	client := newTestServer(t)
+	pipeline := client.Organization("example").Pipeline("app")
+	builds, err := pipeline.BuildsForCommit(context.Background(), "4416ce9a1bbd38505c72f8f9d034a45c41b02a02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 1 || builds[0].Number != 2 {
+		t.Errorf("expected build 2, got %#v", builds)
+	}
+	builds, err = pipeline.BuildsForCommit(context.Background(), "0000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 0 {
+		t.Errorf("expected no builds, got %d", len(builds))
+	}
+}
+
+func TestWaitForBuildNewerCommits(t *testing.T) {
+	// The latest build on the branch is for a newer commit, but WaitForBuild
+	// should still find the build of the one we asked for.
+	client := newSequenceServer(t, `[
+		{"number": 9, "state": "running", "commit": "newer"},
+		{"number": 8, "state": "running", "commit": "new"},
+		{"number": 5, "state": "passed", "commit": "abc"}
+	]`)
+	opts := fastWait
+	opts.OnWaitingForCommit = func(b Build) {
+		t.Errorf("should not wait for the commit, got latest build %d", b.Number)
+	}
+	build, err := client.WaitForBuild(context.Background(), "example", "app", "main", "abc", &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.Number != 5 {
+		t.Errorf("expected build 5, got %d", build.Number)
+	}
+}
+
+func TestIsNetworkError(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"dial", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"dns", &net.DNSError{Err: "no such host", Name: "api.buildkite.com"}, true},
+		{"connection reset", reset, true},
+		{"connection reset in url.Error", &url.Error{Op: "Get", URL: "https://api.buildkite.com", Err: reset}, true},
+		{"EOF", &url.Error{Op: "Get", URL: "https://api.buildkite.com", Err: io.EOF}, true},
+		{"unexpected EOF in url.Error", &url.Error{Op: "Get", URL: "https://api.buildkite.com", Err: io.ErrUnexpectedEOF}, true},
+		{"decoding a truncated body", fmt.Errorf("decoding build: %w", io.ErrUnexpectedEOF), true},
+		{"syntax error from a truncated body", json.Unmarshal([]byte(`{"number": 1`), new(Build)), false},
+		{"syntax error from an empty body", json.Unmarshal(nil, new(Build)), false},
+		{"other read error", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("bad record MAC")}, false},
+		{"api error", ErrNoBuilds, false},
+	}
+	for _, tt := range tests {
+		if got := IsNetworkError(tt.err); got != tt.want {
+			t.Errorf("%s: IsNetworkError(%v) = %t, want %t", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// instantClock is a Clock that never waits.
+type instantClock struct{}
+
+func (instantClock) Now() time.Time { return time.Now() }
+
+func (instantClock) After(time.Duration) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	c <- time.Now()
+	return c
+}
+
+// flakyTransport fails the requests whose numbers (starting at 1) are in fail
+// with a network error, and sends the rest to the real transport.
+type flakyTransport struct {
+	requests int
+	fail     map[int]bool
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.requests++
+	if f.fail[f.requests] {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWaitMaxNetworkRetries(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"number": 12, "state": "running"}`))
+	}))
+	defer s.Close()
+	// Two failures, a success, then two more failures: with a limit of two
+	// the counter resets after the success, so we keep going, and give up
+	// after the third failure in a row.
+	transport := &flakyTransport{fail: map[int]bool{1: true, 2: true, 4: true, 5: true, 6: true}}
+	client := NewClientWithHTTPClient("test-token", &http.Client{Transport: transport})
+	client.Base = s.URL
+	opts := fastWait
+	opts.MaxNetworkRetries = 2
+	opts.Clock = instantClock{}
+	var retried int
+	opts.OnNetworkError = func(error) { retried++ }
+	_, err := client.Organization("example").Pipeline("app").Build(12).Wait(context.Background(), &opts)
+	if err == nil || !IsNetworkError(errors.Unwrap(err)) {
+		t.Fatalf("expected a network error, got %v", err)
+	}
+	if transport.requests != 6 {
+		t.Errorf("expected to give up on the 6th request, made %d", transport.requests)
+	}
+	if retried != 4 {
+		t.Errorf("expected 4 retries, got %d", retried)
+	}
+}
+
+func TestWaitRetriesMaintenancePage(t *testing.T) {
+	requests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("<html><body>Down for maintenance</body></html>"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"number": 12, "state": "passed"}`))
+	}))
+	defer s.Close()
+	client := NewClientWithHTTPClient("test-token", s.Client())
+	client.Base = s.URL
+	opts := fastWait
+	opts.Clock = instantClock{}
+	var retried error
+	opts.OnNetworkError = func(err error) { retried = err }
+	build, err := client.Organization("example").Pipeline("app").Build(12).Wait(context.Background(), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build.State != "passed" || requests != 2 {
+		t.Errorf("expected to retry once and get the passed build, got %q after %d requests", build.State, requests)
+	}
+	if !IsUnavailable(retried) {
+		t.Errorf("expected the maintenance page to be retried, got %v", retried)
+	}
+}
+
+func TestRetryDecodeError(t *testing.T) {
+	// An empty 200 response fails to unmarshal; that's a bad response, not a
+	// network failure, so it shouldn't be retried forever.
+	decodeErr := json.Unmarshal(nil, new(Build))
+	opts := fastWait
+	opts.Clock = instantClock{}
+	opts.OnNetworkError = func(err error) { t.Errorf("unexpected retry of %v", err) }
+	if err := opts.retry(context.Background(), decodeErr, 1); err != decodeErr {
+		t.Errorf("expected the decode error to be returned, got %v", err)
+	}
+	// A connection dropped partway through the body is retried.
+	opts.OnNetworkError = nil
+	if err := opts.retry(context.Background(), io.ErrUnexpectedEOF, 1); err != nil {
+		t.Errorf("expected a truncated body read to be retried, got %v", err)
+	}
+}
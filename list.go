@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// parseSince parses the argument to the -since flag, which is either a
+// duration like "72h", meaning that long before now, or a date like
+// "2024-01-02" (in the local time zone) or an RFC 3339 timestamp.
+func parseSince(val string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(val); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("invalid -since value %q: duration must be positive", val)
+		}
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", val, now.Location()); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf(`invalid -since value %q: use a duration like "72h" or a date like "2024-01-02"`, val)
+}
+
+// firstLine returns the first line of a (commit) message.
+func firstLine(msg string) string {
+	if idx := strings.IndexByte(msg, '\n'); idx >= 0 {
+		return msg[:idx]
+	}
+	return msg
+}
+
+// listOptions configures the behavior of doList.
+type listOptions struct {
+	// Maximum number of builds to show.
+	count int
+	// If non-zero, only show builds created after this time.
+	since time.Time
+	// If non-empty, only show builds in this state.
+	state string
+	// How to print each build; see parseBuildFormat.
+	format *buildFormatter
+	// If true, only show builds started by the owner of the API token.
+	mine bool
+}
+
+// buildsCreatedBy returns the builds in builds that user started. Builds
+// without a creator, like ones started by a webhook or a schedule, are left
+// out.
+func buildsCreatedBy(builds []buildkite.Build, user buildkite.User) []buildkite.Build {
+	var mine []buildkite.Build
+	for _, build := range builds {
+		if build.Creator != nil && build.Creator.ID == user.ID {
+			mine = append(mine, build)
+		}
+	}
+	return mine
+}
+
+// doList prints the most recent builds on branch, or on every branch if
+// branch is empty.
+func doList(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, opts listOptions) error {
+	query := url.Values{
+		"per_page": []string{strconv.Itoa(opts.count)},
+	}
+	if branch != "" {
+		query.Set("branch", branch)
+	}
+	if !opts.since.IsZero() {
+		query.Set("created_from", opts.since.UTC().Format(time.RFC3339))
+	}
+	if opts.state != "" {
+		query.Set("state", opts.state)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var user buildkite.User
+	if opts.mine {
+		var err error
+		user, err = client.CurrentUser(ctx)
+		if err != nil {
+			return err
+		}
+		query.Set("creator", user.ID)
+	}
+	builds, err := client.Organization(org.Name).Pipeline(pipeline).ListBuilds(ctx, query)
+	if err != nil {
+		return err
+	}
+	if opts.mine {
+		// The API filters by creator already; this is in case it ignores
+		// the parameter.
+		builds = buildsCreatedBy(builds, user)
+	}
+	if len(builds) == 0 {
+		where := "for " + branch
+		if branch == "" {
+			where = "on any branch"
+		}
+		if opts.mine {
+			where = "by " + user.Name + " " + where
+		}
+		fmt.Fprintf(os.Stderr, "No builds found %s in %s/%s\n", where, org.Name, pipeline)
+		return nil
+	}
+	return opts.format.Write(os.Stdout, builds)
+}
@@ -6,25 +6,43 @@
 //
 // The commands are:
 //
+//	cancel-all          Cancel all running builds on a branch
+//	config              Print the config file in use and its organizations
+//	create              Start a new build of a branch
+//	download-log        Save the full log of a job to a file
+//	env                 Print the environment of a job in the latest build
+//	jobs                List the jobs in the latest build
+//	list                List recent builds on a branch
+//	pipelines           List the pipelines in an organization
+//	rebuild             Rebuild a past build of the pipeline
+//	retry               Retry a job in the latest build
+//	status              Print the state of the latest build on a branch
+//	trigger             Start a build of any branch or commit, outside a checkout
 //	version             Print the current version
 //	wait                Wait for tests to finish on a branch.
+//	whoami              Show the Buildkite user for the API token
 //
 // Use "buildkite help [command]" for more information about a command.
 package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"net"
+	"io"
+	"log/slog"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/kevinburke/bigtext"
 	buildkite "github.com/kevinburke/buildkite/lib"
 	git "github.com/kevinburke/go-git"
+	"github.com/kevinburke/rest/resterror"
 	"github.com/pkg/browser"
 )
 
@@ -36,9 +54,22 @@ Usage:
 
 The commands are:
 
+	cancel-all          Cancel all running builds on a branch
+	config              Print the config file in use and its organizations
+	create              Start a new build of a branch
+	download-log        Save the full log of a job to a file
+	env                 Print the environment of a job in the latest build
+	jobs                List the jobs in the latest build
+	list                List recent builds on a branch
 	open                Open the running build in your browser
+	pipelines           List the pipelines in an organization
+	rebuild             Rebuild a past build of the pipeline
+	retry               Retry a job in the latest build
+	status              Print the state of the latest build on a branch
+	trigger             Start a build of any branch or commit, outside a checkout
 	version             Print the current version
 	wait                Wait for tests to finish on a branch.
+	whoami              Show the Buildkite user for the API token
 
 Use "buildkite help [command]" for more information about a command.
 `
@@ -52,12 +83,21 @@ func init() {
 	flag.Usage = usage
 }
 
-func newClient(cfg *buildkite.FileConfig, gitRemote string) (*buildkite.Client, error) {
-	token, err := cfg.Token(gitRemote)
-	if err != nil {
-		return nil, err
+var debug = flag.Bool("debug", false, "Print debug logging to stderr")
+var logFormat = flag.String("log-format", "text", `Format of log messages on stderr: "text" or "json"`)
+
+// newLogHandler returns a slog.Handler that writes to w in format, "text" or
+// "json", at level and above.
+func newLogHandler(w io.Writer, format string, level slog.Level) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("unknown -log-format %q, want text or json", format)
 	}
-	return buildkite.NewClient(token), nil
 }
 
 func main() {
@@ -65,19 +105,280 @@ func main() {
 	defer cancel()
 	waitflags := flag.NewFlagSet("wait", flag.ExitOnError)
 	openflags := flag.NewFlagSet("open", flag.ExitOnError)
-	waitRemote := waitflags.String("remote", "origin", "Git remote to use")
+	jobsflags := flag.NewFlagSet("jobs", flag.ExitOnError)
+	downloadlogflags := flag.NewFlagSet("download-log", flag.ExitOnError)
+	statusflags := flag.NewFlagSet("status", flag.ExitOnError)
+	versionflags := flag.NewFlagSet("version", flag.ExitOnError)
+	cancelallflags := flag.NewFlagSet("cancel-all", flag.ExitOnError)
+	pipelinesflags := flag.NewFlagSet("pipelines", flag.ExitOnError)
+	listflags := flag.NewFlagSet("list", flag.ExitOnError)
+	rebuildflags := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	configflags := flag.NewFlagSet("config", flag.ExitOnError)
+	retryflags := flag.NewFlagSet("retry", flag.ExitOnError)
+	whoamiflags := flag.NewFlagSet("whoami", flag.ExitOnError)
+	envflags := flag.NewFlagSet("env", flag.ExitOnError)
+	createflags := flag.NewFlagSet("create", flag.ExitOnError)
+	triggerflags := flag.NewFlagSet("trigger", flag.ExitOnError)
+	waitTarget := addTargetFlags(waitflags)
 	waitOutputLines := waitflags.Int("failed-output-lines", 100, "Number of lines of failed output to display")
+	waitQuiet := waitflags.Bool("quiet", false, "Only print output if the build fails")
+	waitNotify := waitflags.Bool("notify", true, "Display a desktop notification when the build completes")
+	waitAnnotationContext := waitflags.String("annotation-context", "", "Only show annotations with this context (e.g. \"test-summary\")")
+	waitAnnotationStyle := waitflags.String("annotation-style", "", "Only show annotations with this style (success, info, warning or error)")
+	waitOnlyFailedAnnotations := waitflags.Bool("only-failed-annotations", false, "Only show annotations with the error or warning style, whether the build passes or fails")
+	waitIncludePassedAnnotations := waitflags.Bool("include-passed-annotations", false, "When the build passes, show its info annotations too")
+	waitAnnotations := waitflags.String("annotations", "", "How to print build annotations: ansi, markdown, html or none (default ansi on a terminal, markdown otherwise)")
+	waitNoAnnotations := waitflags.Bool("no-annotations", false, "Don't fetch or print build annotations; the same as -annotations=none")
+	waitFollowTriggers := waitflags.Bool("follow-triggers", false, "After the build passes, wait for the builds started by its trigger steps")
+	waitTriggerDepth := waitflags.Int("trigger-depth", defaultTriggerDepth, "With -follow-triggers, how many levels of triggered builds to follow")
+	waitDefaultBranch := waitflags.Bool("default-branch", false, "Wait for the latest build on the default branch (default_branch in the config, or the git remote's), instead of a build of the local commit")
+	waitCommit := waitflags.String("commit", "", "Wait for a build of this commit, instead of the tip of the branch")
+	waitBuild := waitflags.Int64("build", 0, "Wait for this build number, instead of the latest build on the branch")
+	waitRetryNetwork := waitflags.Int("retry-network", 0, "Give up after this many network errors in a row (default retry forever)")
+	waitWeb := waitflags.Bool("web", false, "Open the build in your browser when it finishes, like \"open\"")
+	waitJSONStream := waitflags.Bool("json-stream", false, "Print progress as newline-delimited JSON events instead of text, ending with an event for the result")
+	waitPrint := waitflags.Bool("print", false, "With -web, print the build URL instead of opening it in a browser")
+	waitAutoUnblock := waitflags.Bool("auto-unblock", false, "If the build reaches a block step, unblock it and keep waiting, instead of exiting")
+	waitIncludeRetriedJobs := waitflags.Bool("include-retried-jobs", false, "List earlier attempts of retried jobs in the summary, to help debug flaky jobs")
+	waitFailFast := waitflags.Bool("fail-fast", false, "Stop waiting as soon as any job fails, even if the rest of the build is still running")
+	waitAllBranches := waitflags.Bool("all-branches", false, "Wait for a build of the commit on any branch, for when you don't know which branch it was pushed to")
+	waitUnpushedTimeout := waitflags.Duration("unpushed-timeout", 0, "If the local commit hasn't been pushed, give up after this long (default wait forever)")
+	waitLogTimestamps := waitflags.Bool("log-timestamps", false, "Keep the Buildkite agent's timestamp escape sequences in failed output")
+	waitInterval := waitflags.Duration("interval", 0, "How often to check the build (default 3s, or 5s while waiting for the build to start)")
 	waitflags.Usage = func() {
 		fmt.Fprintf(os.Stderr, `usage: wait [refspec]
 
 Wait for builds to complete, then print a descriptive output on success or
 failure. By default, waits on the current branch, otherwise you can pass a
-branch to wait for.
+branch to wait for. Pass -build to wait for a specific build, for example one
+you started with the API.
 
 `)
 		waitflags.PrintDefaults()
 	}
+	openTarget := addTargetFlags(openflags)
+	openInterval := openflags.Duration("interval", 0, "How often to check for a build of the local commit at first (default 2s)")
+	openPrint := openflags.Bool("print", false, "Print the build URL instead of opening it in a browser")
+	openBuildOnly := openflags.Bool("build", false, "Open the build page, instead of the first failed job if the build failed")
+	openRetryNetwork := openflags.Int("retry-network", 0, "Give up after this many network errors in a row (default retry forever)")
+	openLatest := openflags.Bool("latest", false, "Use the latest build on the branch, instead of waiting for a build of the local commit")
+	jobsTarget := addTargetFlags(jobsflags)
+	jobsFailed := jobsflags.Bool("failed", false, "Only show failed jobs")
+	jobsState := jobsflags.String("state", "", "Only show jobs in this state (e.g. \"running\")")
+	jobsflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: jobs [refspec]
+
+Print the name, state and duration of every job in the latest build. By
+default, uses the current branch, otherwise you can pass a branch.
+
+`)
+		jobsflags.PrintDefaults()
+	}
+	pipelinesTarget := addOrgFlags(pipelinesflags)
+	pipelinesFilter := pipelinesflags.String("filter", "", "Only show pipelines whose slug, name or repository contain this string")
+	pipelinesJSON := pipelinesflags.Bool("json", false, "Print the pipelines as a JSON array, with every field the API returns")
+	pipelinesflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: pipelines
+
+Print the slug, name and repository of every pipeline in the Buildkite
+organization, along with the number of running and scheduled builds.
+
+With -json, each page of pipelines is printed as it's fetched, so the whole
+list never needs to be in memory.
+
+`)
+		pipelinesflags.PrintDefaults()
+	}
+	createTarget := addTargetFlags(createflags)
+	var createOpts createOptions
+	createflags.StringVar(&createOpts.commit, "commit", "", "Commit to build (default the tip of the branch)")
+	createflags.Var(&createOpts.env, "env", "Environment variable to set for the build, as KEY=VALUE (can be repeated)")
+	createflags.Var(&createOpts.meta, "meta", "Meta-data to set on the build, as KEY=VALUE (can be repeated)")
+	createflags.StringVar(&createOpts.message, "message", "", "Build message (default the commit's subject)")
+	createflags.StringVar(&createOpts.author, "author", "", `Author to show for the build, as "Name <email>" (default from git config)`)
+	createflags.BoolVar(&createOpts.json, "json", false, `Print the new build as JSON, e.g. {"number": 12, "web_url": "...", "state": "scheduled", ...}`)
+	createflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: create [refspec]
+
+Start a new build of a branch, and print its number and URL. By default,
+builds the tip of the current branch, otherwise you can pass a branch.
+
+create doesn't wait for the build to finish, and exits 0 once the build is
+created, whatever its result. Use -json to get the build's number and URL in
+a script, and "wait" to wait for it later.
+
+`)
+		createflags.PrintDefaults()
+	}
+	triggerOrg := triggerflags.String("org", "", "Buildkite org to use (default the org the config maps the pipeline to, or the default org)")
+	triggerPipeline := triggerflags.String("pipeline", "", "Buildkite pipeline slug to build")
+	triggerBranch := triggerflags.String("branch", "", "Branch to build")
+	var triggerOpts createOptions
+	triggerflags.StringVar(&triggerOpts.commit, "commit", "", "Commit to build (default the tip of the branch)")
+	triggerflags.Var(&triggerOpts.env, "env", "Environment variable to set for the build, as KEY=VALUE (can be repeated)")
+	triggerflags.Var(&triggerOpts.meta, "meta", "Meta-data to set on the build, as KEY=VALUE (can be repeated)")
+	triggerflags.StringVar(&triggerOpts.message, "message", "", "Build message")
+	triggerflags.StringVar(&triggerOpts.author, "author", "", `Author to show for the build, as "Name <email>"`)
+	triggerflags.BoolVar(&triggerOpts.json, "json", false, "Print the new build as JSON")
+	triggerflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: trigger -pipeline <slug> -branch <branch> [-commit <sha>]
+
+Start a new build of any branch or commit, and print its number and URL. Unlike
+create, trigger doesn't look at the git repository in the current directory,
+so it can run anywhere, e.g. from a central automation host.
+
+`)
+		triggerflags.PrintDefaults()
+	}
+	envTarget := addTargetFlags(envflags)
+	envJob := envflags.String("job", "", "Name of the job to show (case insensitive, matches a substring)")
+	envShowSecrets := envflags.Bool("show-secrets", false, "Show the values of variables whose names contain TOKEN, SECRET or PASSWORD")
+	envflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: env -job <name> [refspec]
+
+Print the environment variables that were set for a job in the latest build.
+By default, uses the current branch, otherwise you can pass a branch.
+
+`)
+		envflags.PrintDefaults()
+	}
+	downloadlogTarget := addTargetFlags(downloadlogflags)
+	downloadlogJob := downloadlogflags.String("job", "", "Name of the job to download (case insensitive, matches a substring; default the first failed job)")
+	downloadlogOutput := downloadlogflags.String("o", "", "File to write the log to (default <pipeline>-<build>-<job>.log)")
+	downloadlogflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: download-log [-job <name>] [-o path] [refspec]
+
+Save the complete log of a job in the latest build to a file, and print the
+path written. By default, uses the current branch, otherwise you can pass a
+branch.
+
+`)
+		downloadlogflags.PrintDefaults()
+	}
+	statusTarget := addTargetFlags(statusflags)
+	statusExitZeroOnRunning := statusflags.Bool("exit-zero-on-running", false, "Exit 0 if the build hasn't finished yet, instead of 2")
+	statusFormat := statusflags.String("format", "", `How to print the build: "short", "wide", "json", or a Go template like '{{.Number}} {{.State}}' (default a description of its state)`)
+	statusflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: status [refspec]
+
+Print the state of the latest build on a branch, without waiting for it to
+finish. By default, uses the current branch, otherwise you can pass a branch.
+
+The exit code is:
+
+	0  the build passed
+	1  the build failed, was canceled, or can't pass (or there was an error)
+	2  the build is still running or scheduled (0 with -exit-zero-on-running)
+
+`)
+		statusflags.PrintDefaults()
+	}
+	cancelallTarget := addTargetFlags(cancelallflags)
+	cancelallflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: cancel-all [refspec]
+
+Cancel every running or scheduled build on a branch, for example after
+pushing several commits in a row. By default, uses the current branch,
+otherwise you can pass a branch.
+
+`)
+		cancelallflags.PrintDefaults()
+	}
+	versionCheck := versionflags.Bool("check", false, "Check GitHub for a newer version (the result is cached for a day)")
+	versionflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: version [-check]
+
+Print the current version. With -check, also print whether a newer version
+has been released. If GitHub can't be reached, only the current version is
+printed.
+
+`)
+		versionflags.PrintDefaults()
+	}
+	whoamiTarget := addOrgFlags(whoamiflags)
+	whoamiflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: whoami
+
+Print the name and email of the Buildkite user that owns the API token for
+the current git remote (or -org), and the organizations the token can access.
+
+`)
+		whoamiflags.PrintDefaults()
+	}
+	listTarget := addTargetFlags(listflags)
+	listCount := listflags.Int("n", 10, "Number of builds to show")
+	listSince := listflags.String("since", "", `Only show builds created after this time, e.g. "72h" or "2024-01-02"`)
+	listState := listflags.String("state", "", `Only show builds in this state (e.g. "failed")`)
+	listMine := listflags.Bool("mine", false, "Only show builds started by the owner of the API token, on any branch unless you pass one")
+	listFormat := listflags.String("format", "short", `How to print each build: "short", "wide", "json", or a Go template like '{{.Number}} {{.State}}'`)
+	listflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: list [refspec]
+
+List the most recent builds on a branch. By default, uses the current branch,
+otherwise you can pass a branch. With -mine, lists your builds on every branch,
+unless you pass one.
+
+Templates passed to -format can use any field of a build (e.g. .Number,
+.State, .Commit, .Branch, .WebURL) and the helpers .ShortCommit, .Title,
+.Created and .Elapsed.
+
+`)
+		listflags.PrintDefaults()
+	}
+	rebuildTarget := addTargetFlags(rebuildflags)
+	rebuildFrom := rebuildflags.Int64("from", 0, "Number of the build to rebuild")
+	rebuildJSON := rebuildflags.Bool("json", false, `Print the new build as JSON, e.g. {"number": 12, "web_url": "...", "state": "scheduled", ...}`)
+	// rebuild never waits for the build, but scripts written against create
+	// and wait pass -no-wait to say so.
+	rebuildflags.Bool("no-wait", false, "Return as soon as the build is created (the default; rebuild never waits)")
+	rebuildflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: rebuild -from <number>
+
+Start a new build with the same commit, branch and environment as a past
+build, and print its number and URL. It doesn't wait for the build to finish,
+and exits 0 once the build is created; use wait -build to wait for it. To
+start a build at the tip of a branch, use create instead.
+
+`)
+		rebuildflags.PrintDefaults()
+	}
+	configflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: config path
+
+Print the path of the config file, or the locations that were checked if
+there isn't one, and the organizations it configures, with their tokens
+redacted. Use this to find out why a command picks the wrong org.
+
+`)
+		configflags.PrintDefaults()
+	}
+	retryTarget := addTargetFlags(retryflags)
+	retryJob := retryflags.String("job", "", "Name of the job to retry (case insensitive, matches a substring)")
+	retryflags.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: retry -job <name> [refspec]
+
+Retry a job in the latest build. By default, uses the current branch,
+otherwise you can pass a branch.
+
+`)
+		retryflags.PrintDefaults()
+	}
 	flag.Parse()
+	// Set up logging before running any command, so every log message uses
+	// the same format.
+	if *debug || *logFormat != "text" {
+		level := slog.LevelInfo
+		if *debug {
+			level = slog.LevelDebug
+		}
+		handler, err := newLogHandler(os.Stderr, *logFormat, level)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "buildkite: %v\n\n", err)
+			usage()
+			os.Exit(2)
+		}
+		slog.SetDefault(slog.New(handler))
+	}
 	mainArgs := flag.Args()
 	if len(mainArgs) < 1 {
 		usage()
@@ -85,36 +386,226 @@ branch to wait for.
 	}
 	subargs := mainArgs[1:]
 	if flag.Arg(0) == "version" {
-		fmt.Fprintf(os.Stdout, "buildkite version %s\n", buildkite.Version)
+		versionflags.Parse(subargs)
+		doVersion(ctx, *versionCheck)
+		os.Exit(0)
+	}
+	if flag.Arg(0) == "config" {
+		configflags.Parse(subargs)
+		if configflags.NArg() != 1 || configflags.Arg(0) != "path" {
+			configflags.Usage()
+			os.Exit(2)
+		}
+		checkError(doConfigPath(ctx, os.Stdout), "loading buildkite config")
 		os.Exit(0)
 	}
 	cfg, err := buildkite.LoadConfig(ctx)
 	checkError(err, "loading buildkite config")
-	remote, err := git.GetRemoteURL(*waitRemote)
-	checkError(err, "loading git info")
-	gitRemote := remote.Path
-	org, ok := cfg.OrgForRemote(gitRemote)
-	if !ok {
-		checkError(fmt.Errorf("could not find a Buildkite org for remote %q", gitRemote), "")
-	}
-	client, err := newClient(cfg, gitRemote)
-	if err != nil {
-		checkError(err, "creating Buildkite client")
+	for _, dup := range cfg.DuplicateRemotes() {
+		fmt.Fprintf(os.Stderr, "Warning: git remote %q is in the git_remotes of more than one organization (%s); using %s\n",
+			dup.Remote, strings.Join(dup.Orgs, ", "), dup.Orgs[0])
 	}
 	switch flag.Arg(0) {
 	case "wait":
 		waitflags.Parse(subargs)
+		client, org, pipeline, err := resolveTarget(cfg, waitTarget)
+		checkError(err, "finding Buildkite pipeline")
 		args := waitflags.Args()
-		branch, err := getBranchFromArgs(args)
+		var branch string
+		if *waitAllBranches && (*waitDefaultBranch || len(args) > 0) {
+			checkError(errors.New("can't pass a branch or -default-branch with -all-branches"), "parsing flags")
+		}
+		if *waitDefaultBranch && *waitCommit != "" {
+			checkError(errors.New("can't pass -commit with -default-branch"), "parsing flags")
+		}
+		if *waitBuild < 0 {
+			checkError(errors.New("-build must be a positive build number"), "parsing flags")
+		}
+		if *waitBuild > 0 && (*waitAllBranches || *waitDefaultBranch || *waitCommit != "" || len(args) > 0) {
+			checkError(errors.New("can't pass a branch, -commit, -default-branch or -all-branches with -build"), "parsing flags")
+		}
+		if *waitJSONStream && (*waitWeb || *waitFollowTriggers) {
+			checkError(errors.New("can't pass -web or -follow-triggers with -json-stream"), "parsing flags")
+		}
+		switch {
+		case *waitBuild > 0:
+			// Leave branch empty; it comes from the build.
+		case *waitAllBranches:
+			// Leave branch empty, which means any branch.
+		case *waitDefaultBranch:
+			if len(args) > 0 {
+				checkError(errors.New("can't pass a branch with -default-branch"), "parsing flags")
+			}
+			branch, err = orgDefaultBranch(org, *waitTarget.remote)
+		default:
+			branch, err = getBranchForOrg(args, org)
+			if err == errNoBranch {
+				// HEAD is detached; wait for a build of it on any branch.
+				branch, err = "", nil
+			}
+		}
 		checkError(err, "getting git branch")
-		err = doWait(ctx, client, org, remote, branch, *waitOutputLines)
+		checkError(validateInterval(*waitInterval), "parsing flags")
+		client.FailureOptions = &buildkite.FailureOptions{KeepTimestamps: *waitLogTimestamps}
+		annotationFormat, err := parseAnnotationFormat(*waitAnnotations, isatty())
+		checkError(err, "parsing flags")
+		if *waitNoAnnotations {
+			annotationFormat = annotationsNone
+		}
+		err = doWait(ctx, client, org, pipeline, branch, waitOptions{
+			numOutputLines:           *waitOutputLines,
+			quiet:                    *waitQuiet,
+			notify:                   *waitNotify,
+			interval:                 *waitInterval,
+			annotationContext:        *waitAnnotationContext,
+			annotationStyle:          *waitAnnotationStyle,
+			onlyFailedAnnotations:    *waitOnlyFailedAnnotations,
+			includePassedAnnotations: *waitIncludePassedAnnotations,
+			annotationFormat:         annotationFormat,
+			followTriggers:           *waitFollowTriggers,
+			triggerDepth:             *waitTriggerDepth,
+			unpushedTimeout:          *waitUnpushedTimeout,
+			latest:                   *waitDefaultBranch,
+			commit:                   *waitCommit,
+			build:                    *waitBuild,
+			failFast:                 *waitFailFast,
+			autoUnblock:              *waitAutoUnblock,
+			web:                      *waitWeb,
+			retryNetwork:             *waitRetryNetwork,
+			printURL:                 *waitPrint,
+			includeRetriedJobs:       *waitIncludeRetriedJobs,
+			jsonStream:               *waitJSONStream,
+		})
 		checkError(err, "waiting for branch")
 	case "open":
 		openflags.Parse(subargs)
+		client, org, pipeline, err := resolveTarget(cfg, openTarget)
+		checkError(err, "finding Buildkite pipeline")
 		args := openflags.Args()
+		branch, err := getBranchForOrg(args, org)
+		checkError(err, "getting git branch")
+		checkError(validateInterval(*openInterval), "parsing flags")
+		checkError(doOpen(ctx, client, org, pipeline, branch, openOptions{
+			interval:     *openInterval,
+			print:        *openPrint,
+			latest:       *openLatest,
+			buildOnly:    *openBuildOnly,
+			retryNetwork: *openRetryNetwork,
+		}), "opening build")
+	case "jobs":
+		jobsflags.Parse(subargs)
+		client, org, pipeline, err := resolveTarget(cfg, jobsTarget)
+		checkError(err, "finding Buildkite pipeline")
+		args := jobsflags.Args()
 		branch, err := getBranchFromArgs(args)
 		checkError(err, "getting git branch")
-		checkError(doOpen(ctx, openflags, client, org, remote, branch), "opening build")
+		checkError(doJobs(ctx, client, org, pipeline, branch, *jobsFailed, *jobsState), "listing jobs")
+	case "list":
+		listflags.Parse(subargs)
+		client, org, pipeline, err := resolveTarget(cfg, listTarget)
+		checkError(err, "finding Buildkite pipeline")
+		var branch string
+		if !*listMine || listflags.NArg() > 0 {
+			branch, err = getBranchFromArgs(listflags.Args())
+			checkError(err, "getting git branch")
+		}
+		opts := listOptions{count: *listCount, state: *listState, mine: *listMine}
+		opts.format, err = parseBuildFormat(*listFormat)
+		checkError(err, "parsing flags")
+		if *listSince != "" {
+			opts.since, err = parseSince(*listSince, time.Now())
+			checkError(err, "parsing flags")
+		}
+		checkError(doList(ctx, client, org, pipeline, branch, opts), "listing builds")
+	case "retry":
+		retryflags.Parse(subargs)
+		if normalizeJobName(*retryJob) == "" {
+			retryflags.Usage()
+			os.Exit(2)
+		}
+		client, org, pipeline, err := resolveTarget(cfg, retryTarget)
+		checkError(err, "finding Buildkite pipeline")
+		branch, err := getBranchFromArgs(retryflags.Args())
+		checkError(err, "getting git branch")
+		checkError(doRetry(ctx, client, org, pipeline, branch, *retryJob), "retrying job")
+	case "rebuild":
+		rebuildflags.Parse(subargs)
+		if *rebuildFrom <= 0 || rebuildflags.NArg() > 0 {
+			rebuildflags.Usage()
+			os.Exit(2)
+		}
+		client, org, pipeline, err := resolveTarget(cfg, rebuildTarget)
+		checkError(err, "finding Buildkite pipeline")
+		checkError(doRebuild(ctx, os.Stdout, client, org, pipeline, *rebuildFrom, *rebuildJSON), "rebuilding build")
+	case "cancel-all":
+		cancelallflags.Parse(subargs)
+		client, org, pipeline, err := resolveTarget(cfg, cancelallTarget)
+		checkError(err, "finding Buildkite pipeline")
+		branch, err := getBranchFromArgs(cancelallflags.Args())
+		checkError(err, "getting git branch")
+		checkError(doCancelAll(ctx, client, org, pipeline, branch), "canceling builds")
+	case "create":
+		createflags.Parse(subargs)
+		client, org, pipeline, err := resolveTarget(cfg, createTarget)
+		checkError(err, "finding Buildkite pipeline")
+		branch, err := getBranchFromArgs(createflags.Args())
+		checkError(err, "getting git branch")
+		checkError(doCreate(ctx, client, org, pipeline, branch, createOpts), "creating build")
+	case "trigger":
+		triggerflags.Parse(subargs)
+		if *triggerPipeline == "" || *triggerBranch == "" || triggerflags.NArg() > 0 {
+			triggerflags.Usage()
+			os.Exit(2)
+		}
+		client, org, err := resolveOrgForPipeline(cfg, *triggerOrg, *triggerPipeline)
+		checkError(err, "finding Buildkite org")
+		checkError(doTrigger(ctx, client, org, *triggerPipeline, *triggerBranch, triggerOpts), "creating build")
+	case "env":
+		envflags.Parse(subargs)
+		if normalizeJobName(*envJob) == "" {
+			envflags.Usage()
+			os.Exit(2)
+		}
+		client, org, pipeline, err := resolveTarget(cfg, envTarget)
+		checkError(err, "finding Buildkite pipeline")
+		branch, err := getBranchFromArgs(envflags.Args())
+		checkError(err, "getting git branch")
+		checkError(doEnv(ctx, client, org, pipeline, branch, *envJob, *envShowSecrets), "getting job environment")
+	case "download-log":
+		downloadlogflags.Parse(subargs)
+		if *downloadlogJob != "" && normalizeJobName(*downloadlogJob) == "" {
+			downloadlogflags.Usage()
+			os.Exit(2)
+		}
+		client, org, pipeline, err := resolveTarget(cfg, downloadlogTarget)
+		checkError(err, "finding Buildkite pipeline")
+		branch, err := getBranchFromArgs(downloadlogflags.Args())
+		checkError(err, "getting git branch")
+		checkError(doDownloadLog(ctx, client, org, pipeline, branch, *downloadlogJob, *downloadlogOutput), "downloading job log")
+	case "pipelines":
+		pipelinesflags.Parse(subargs)
+		client, org, _, err := resolveOrg(cfg, pipelinesTarget)
+		checkError(err, "finding Buildkite org")
+		checkError(doPipelines(ctx, client, org, *pipelinesFilter, *pipelinesJSON), "listing pipelines")
+	case "status":
+		statusflags.Parse(subargs)
+		client, org, pipeline, err := resolveTarget(cfg, statusTarget)
+		checkError(err, "finding Buildkite pipeline")
+		branch, err := getBranchForOrg(statusflags.Args(), org)
+		checkError(err, "getting git branch")
+		var format *buildFormatter
+		if *statusFormat != "" {
+			format, err = parseBuildFormat(*statusFormat)
+			checkError(err, "parsing flags")
+		}
+		build, err := doStatus(ctx, os.Stdout, client, org, pipeline, branch, format)
+		checkError(err, "getting build status")
+		os.Exit(statusExitCode(build, *statusExitZeroOnRunning))
+	case "whoami":
+		whoamiflags.Parse(subargs)
+		client, org, _, err := resolveOrg(cfg, whoamiTarget)
+		checkError(err, "finding Buildkite org")
+		checkError(doWhoami(ctx, client, org), "finding Buildkite user")
 	default:
 		fmt.Fprintf(os.Stderr, "buildkite: unknown command %q\n\n", flag.Arg(0))
 		usage()
@@ -133,11 +624,23 @@ func failError(err error, msg string) {
 	os.Exit(1)
 }
 
-func getBuilds(ctx context.Context, client *buildkite.Client, org, repo, branch string) ([]buildkite.Build, error) {
+// previousBuildCount is the number of recent builds to fetch at a time while
+// scanning for a passing build, which is used to estimate how long the current
+// build will take.
+const previousBuildCount = 10
+
+// maxBuildsToScan is the default limit on the number of recent builds to scan
+// for a passing build; see waitOptions.maxBuildsToScan.
+const maxBuildsToScan = 50
+
+// getBuilds returns a page of the most recent builds on branch, newest first,
+// with count builds per page. Pages are numbered from 1.
+func getBuilds(ctx context.Context, client *buildkite.Client, org, repo, branch string, count, page int) ([]buildkite.Build, error) {
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	builds, err := client.Organization(org).Pipeline(repo).ListBuilds(ctx, url.Values{
-		"per_page": []string{"3"},
+		"per_page": []string{strconv.Itoa(count)},
+		"page":     []string{strconv.Itoa(page)},
 		"branch":   []string{branch},
 	})
 	if err != nil {
@@ -146,56 +649,207 @@ func getBuilds(ctx context.Context, client *buildkite.Client, org, repo, branch
 	return builds, nil
 }
 
-func getLatestBuild(ctx context.Context, client *buildkite.Client, org, repo, branch string) (buildkite.Build, error) {
-	builds, err := getBuilds(ctx, client, org, repo, branch)
-	if err != nil {
-		return buildkite.Build{}, err
+// scanPreviousBuilds pages through the builds on branch, perPage at a time,
+// until findPreviousBuild finds a passing one or it has looked at max builds.
+// It returns nil if there isn't a passing build, or the builds can't be
+// fetched.
+func scanPreviousBuilds(ctx context.Context, client *buildkite.Client, org, repo, branch string, perPage, max int) *buildkite.Build {
+	var builds []buildkite.Build
+	for page := 1; len(builds) < max; page++ {
+		next, err := getBuilds(ctx, client, org, repo, branch, perPage, page)
+		if err != nil {
+			return nil
+		}
+		more := len(next) == perPage
+		if len(builds)+len(next) > max {
+			next = next[:max-len(builds)]
+		}
+		builds = append(builds, next...)
+		if prev := findPreviousBuild(builds); prev != nil {
+			return prev
+		}
+		if !more {
+			return nil
+		}
 	}
-	if len(builds) == 0 {
-		return buildkite.Build{}, errNoBuilds
+	return nil
+}
+
+// failFast prints the output of the jobs that have failed in build, which is
+// still running, and returns an error naming them.
+func failFast(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, build buildkite.Build, opts waitOptions) error {
+	data := client.BuildSummary(ctx, org.Name, pipeline, build, opts.numOutputLines)
+	os.Stdout.Write(data)
+	fmt.Printf("\nURL:\n%s\n", build.WebURL)
+	fmt.Print(buildAnnotations(ctx, client, org.Name, pipeline, build, opts, failedBuildAnnotations))
+	notify(newNotifier("buildkite ("+pipeline+")", opts.notify && !opts.quiet), "job failed")
+	return failedEarlyError(build)
+}
+
+// failedEarlyError returns an error naming the jobs that have failed in build,
+// which is still running.
+func failedEarlyError(build buildkite.Build) error {
+	var names []string
+	for _, job := range build.FailedJobs() {
+		names = append(names, fmt.Sprintf("%q", job.Name))
 	}
-	return builds[0], nil
+	//lint:ignore ST1005 this shows up in public facing error.
+	return fmt.Errorf("Build %d on %s is still running, but %s failed%s\n\n", build.Number, build.Branch, strings.Join(names, ", "), buildOrigin(build))
+}
+
+func getLatestBuild(ctx context.Context, client *buildkite.Client, org, repo, branch string) (buildkite.Build, error) {
+	return client.Organization(org).Pipeline(repo).LatestBuild(ctx, branch)
 }
 
-func getAnnotations(ctx context.Context, client *buildkite.Client, org, repo string, build int64) (buildkite.AnnotationResponse, error) {
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+func getBuild(ctx context.Context, client *buildkite.Client, org, repo string, number int64) (buildkite.Build, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return client.Organization(org).Pipeline(repo).Build(number).Get(ctx, nil)
+}
+
+// withRetriedJobs fetches build again, including the earlier attempts of any
+// jobs that were retried. If that fails, it returns build as it was.
+func withRetriedJobs(ctx context.Context, client *buildkite.Client, org, pipeline string, build buildkite.Build) buildkite.Build {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	return client.Organization(org).Pipeline(repo).Build(build).Annotations(ctx, nil)
+	full, err := client.Organization(org).Pipeline(pipeline).Build(build.Number).Get(ctx, url.Values{
+		buildkite.IncludeRetriedJobs: []string{"true"},
+	})
+	if err != nil {
+		slog.Debug("fetching retried jobs", "build", build.Number, "error", err)
+		return build
+	}
+	return full
 }
 
-// isHttpError checks if the given error is a request timeout or a network
-// failure - in those cases we want to just retry the request.
-func isHttpError(err error) bool {
+// buildAnnotations fetches the build's annotations that match opts, picks the
+// ones to show with filter, and returns them rendered under an "Annotations:"
+// heading. It returns the empty string if there are none to show, or they
+// can't be fetched.
+func buildAnnotations(ctx context.Context, client *buildkite.Client, org, pipeline string, build buildkite.Build, opts waitOptions, filter func(buildkite.AnnotationResponse, waitOptions) buildkite.AnnotationResponse) string {
+	if opts.annotationFormat == annotationsNone {
+		return ""
+	}
+	annotations, err := getAnnotations(ctx, client, org, pipeline, build.Number, opts.annotationContext, opts.annotationStyle)
+	var rendered []string
 	if err == nil {
-		return false
+		rendered, err = renderAnnotations(filter(annotations, opts), opts.annotationFormat, annotationWidth())
+	}
+	if err != nil {
+		// Annotations are extra; don't fail the command over them.
+		slog.Debug("skipping annotations", "build", build.Number, "error", err)
+		return ""
 	}
-	// some net.OpError's are wrapped in a url.Error
-	if uerr, ok := err.(*url.Error); ok {
-		err = uerr.Err
+	if len(rendered) == 0 {
+		return ""
 	}
-	switch err := err.(type) {
-	default:
-		return false
-	case *net.OpError:
-		return err.Op == "dial" && err.Net == "tcp"
-	case *net.DNSError:
+	output := "\nAnnotations:\n"
+	for _, annotation := range rendered {
+		output += annotation + "\n"
+	}
+	return output
+}
+
+// annotationAttempts is how many times getAnnotations tries to fetch
+// annotations, and annotationRetryDelay is how long it waits after the first
+// failure; the delay doubles after each one.
+const annotationAttempts = 3
+
+var annotationRetryDelay = 500 * time.Millisecond
+
+// isTransientError reports whether a request that failed with err might
+// succeed if it's retried.
+func isTransientError(err error) bool {
+	if buildkite.IsNetworkError(err) || errors.Is(err, context.DeadlineExceeded) {
 		return true
-	// Catchall, this needs to go last.
-	case net.Error:
-		return err.Timeout()
 	}
+	rerr, ok := err.(*resterror.Error)
+	return ok && rerr.Status >= 500
+}
+
+// getAnnotations fetches the annotations on a build, optionally filtered by
+// context and style. Old builds may not have an annotations endpoint at all;
+// those are treated as having no annotations. Transient errors are retried a
+// couple of times.
+func getAnnotations(ctx context.Context, client *buildkite.Client, org, repo string, build int64, annotationContext, style string) (buildkite.AnnotationResponse, error) {
+	query := url.Values{}
+	if annotationContext != "" {
+		query.Set("context", annotationContext)
+	}
+	if style != "" {
+		query.Set("style", style)
+	}
+	delay := annotationRetryDelay
+	for attempt := 1; ; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		annotations, err := client.Organization(org).Pipeline(repo).Build(build).Annotations(reqCtx, query)
+		cancel()
+		if rerr, ok := err.(*resterror.Error); ok && rerr.Status == http.StatusNotFound {
+			return nil, nil
+		}
+		if err == nil || attempt == annotationAttempts || !isTransientError(err) || ctx.Err() != nil {
+			return annotations, err
+		}
+		slog.Debug("retrying annotations request", "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// buildOrigin describes who or what started build, e.g.
+// " (started by Jane Doe via ui)", for the end of a summary line. It returns
+// the empty string if the API didn't say.
+func buildOrigin(build buildkite.Build) string {
+	var name string
+	if build.Creator != nil {
+		name = build.Creator.Name
+		if name == "" {
+			name = build.Creator.Email
+		}
+	}
+	switch {
+	case name != "" && build.Source != "":
+		return " (started by " + name + " via " + build.Source + ")"
+	case name != "":
+		return " (started by " + name + ")"
+	case build.Source != "":
+		return " (started via " + build.Source + ")"
+	default:
+		return ""
+	}
+}
+
+// findPreviousBuild returns the most recent passing build in builds, skipping
+// the first (latest) build, or nil if none of them passed. builds should be
+// sorted newest first.
+func findPreviousBuild(builds []buildkite.Build) *buildkite.Build {
+	for i := 1; i < len(builds); i++ {
+		if builds[i].State == "passed" {
+			return &builds[i]
+		}
+	}
+	return nil
 }
 
-var errNoBuilds = errors.New("buildkite: no builds")
+// heartbeatInterval is the longest we will go without printing a status line
+// while a build is running, so it's clear that we are not stuck.
+const heartbeatInterval = time.Minute
 
-func shouldPrint(lastPrinted time.Time, duration time.Duration, latestBuild buildkite.Build, previousBuild *buildkite.Build) bool {
+// shouldPrint reports whether it's time to print another progress message
+// for a build that has been running for duration, given that the last one
+// was printed at lastPrinted. We print more often as the build gets closer to
+// the duration of previousBuild.
+func shouldPrint(now, lastPrinted time.Time, duration time.Duration, latestBuild buildkite.Build, previousBuild *buildkite.Build) bool {
 	_ = latestBuild
-	now := time.Now()
 	var buildDuration time.Duration
 	if previousBuild == nil {
 		buildDuration = 5 * time.Minute
 	} else {
-		buildDuration = previousBuild.FinishedAt.Time.Sub(previousBuild.StartedAt)
+		buildDuration = previousBuild.Duration()
 	}
 	var durToUse time.Duration
 	timeRemaining := buildDuration - duration
@@ -213,177 +867,616 @@ func shouldPrint(lastPrinted time.Time, duration time.Duration, latestBuild buil
 	default:
 		durToUse = 10 * time.Second
 	}
+	if durToUse > heartbeatInterval {
+		durToUse = heartbeatInterval
+	}
 	return lastPrinted.Add(durToUse).Before(now)
 }
 
-func doOpen(ctx context.Context, flags *flag.FlagSet, client *buildkite.Client, org buildkite.Organization, remote *git.RemoteURL, branch string) error {
-	_ = flags
-	tip, err := git.Tip(branch)
-	if err != nil {
-		return err
+// remainingEstimate describes how much longer a build that has been running
+// for elapsed is likely to take, based on the duration of previousBuild, e.g.
+// "~4m remaining based on previous build". It returns the empty string if
+// there's no previous build, or the build has already taken longer.
+func remainingEstimate(elapsed time.Duration, previousBuild *buildkite.Build) string {
+	if previousBuild == nil {
+		return ""
 	}
-	for {
-		latestBuild, err := getLatestBuild(ctx, client, org.Name, remote.RepoName, branch)
-		if err != nil {
-			if isHttpError(err) {
-				fmt.Printf("Caught network error: %s. Continuing\n", err.Error())
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			if err == errNoBuilds {
-				//lint:ignore ST1005 this shows up in public facing error.
-				return fmt.Errorf("No results, are you sure there are tests for %s/%s?\n",
-					remote.Path, remote.RepoName)
-			}
-			return err
-		}
-		if latestBuild.Commit != tip {
-			fmt.Printf("Latest build in Buildkite is %s, waiting for %s...\n",
-				latestBuild.Commit, tip)
-			time.Sleep(5 * time.Second)
+	remaining := previousBuild.Duration() - elapsed
+	if remaining <= 0 {
+		return ""
+	}
+	var s string
+	if remaining < time.Minute {
+		s = remaining.Round(time.Second).String()
+	} else {
+		// Round to the minute, and print "4m" instead of "4m0s".
+		s = strings.TrimSuffix(remaining.Round(time.Minute).String(), "0s")
+	}
+	return "~" + s + " remaining based on previous build"
+}
+
+// withEstimate appends eta, from remainingEstimate, to a status message.
+func withEstimate(msg, eta string) string {
+	if eta == "" {
+		return msg
+	}
+	return msg + "; " + eta
+}
+
+// runningJobsSummary describes the jobs in build that are currently running,
+// e.g. "lint" or "3 jobs: lint, test, ...". Returns the empty string if no jobs
+// are running.
+func runningJobsSummary(build buildkite.Build) string {
+	var names []string
+	for _, job := range build.RunningJobs() {
+		names = append(names, job.Name)
+	}
+	switch len(names) {
+	case 0:
+		return ""
+	case 1, 2:
+		return strings.Join(names, ", ")
+	default:
+		return fmt.Sprintf("%d jobs: %s, ...", len(names), strings.Join(names[:2], ", "))
+	}
+}
+
+const (
+	minCommitPollInterval = 2 * time.Second
+	maxCommitPollInterval = 30 * time.Second
+)
+
+// nextCommitPollInterval returns how long to wait before checking again for a
+// build of the local commit. We check quickly at first, so the build opens
+// soon after it appears, and back off the longer we wait.
+func nextCommitPollInterval(cur time.Duration) time.Duration {
+	if cur >= maxCommitPollInterval {
+		return cur
+	}
+	next := cur * 3 / 2
+	if next > maxCommitPollInterval {
+		return maxCommitPollInterval
+	}
+	return next
+}
+
+// openOptions configures the behavior of doOpen.
+type openOptions struct {
+	// How long to wait between the first checks for a build of the local
+	// commit. Zero means minCommitPollInterval.
+	interval time.Duration
+	// If true, print the build URL to stdout instead of opening a browser.
+	// Progress messages go to stderr, so stdout only has the URL.
+	print bool
+	// If true, use the latest build on the branch, instead of waiting for a
+	// build of the local commit.
+	latest bool
+	// If true, open the build page even if the build failed, instead of
+	// jumping to the failed job.
+	buildOnly bool
+	// How many network errors in a row to retry before giving up. Zero means
+	// retry forever.
+	retryNetwork int
+}
+
+// firstFailedJob returns the job in build that failed first, or false if no
+// jobs failed. Jobs that never started (e.g. "broken" jobs) are only used if
+// no job that ran has failed.
+func firstFailedJob(build buildkite.Build) (buildkite.Job, bool) {
+	failed := build.FailedJobs()
+	if len(failed) == 0 {
+		return buildkite.Job{}, false
+	}
+	first := -1
+	for i, job := range failed {
+		if job.StartedAt.IsZero() || !job.FinishedAt.Valid {
 			continue
 		}
-		if err := browser.OpenURL(latestBuild.WebURL); err != nil {
-			return err
+		if first == -1 || job.FinishedAt.Time.Before(failed[first].FinishedAt.Time) {
+			first = i
 		}
-		return nil
 	}
+	if first == -1 {
+		first = 0
+	}
+	return failed[first], true
 }
 
-func doWait(ctx context.Context, client *buildkite.Client, org buildkite.Organization, remote *git.RemoteURL, branch string, numOutputLines int) error {
-	tip, err := git.Tip(branch)
-	if err != nil {
-		return err
+// openBuildURL returns the URL to open for build: the first failed job, if
+// the build failed, or else the build itself.
+func openBuildURL(build buildkite.Build, buildOnly bool) string {
+	if buildOnly || (build.State != "failed" && build.State != "failing") {
+		return build.WebURL
 	}
-	fmt.Println("Waiting for latest build on", branch, "to complete")
-	var lastPrintedAt time.Time
-	var previousBuild *buildkite.Build
-	builds, err := getBuilds(ctx, client, org.Name, remote.RepoName, branch)
-	if err == nil {
-		for i := 1; i < len(builds); i++ {
-			if builds[i].State == "passed" {
-				previousBuild = &builds[i]
-				break
-			}
+	if job, ok := firstFailedJob(build); ok {
+		return job.WebURL(build.WebURL)
+	}
+	return build.WebURL
+}
+
+func doOpen(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, opts openOptions) error {
+	var tip string
+	if !opts.latest {
+		var err error
+		tip, err = git.Tip(branch)
+		if err != nil {
+			return err
 		}
+		warnIfUnpushed(tip)
 	}
-	done := false
-	for !done {
-		latestBuild, err := getLatestBuild(ctx, client, org.Name, remote.RepoName, branch)
+	progress := os.Stdout
+	if opts.print {
+		progress = os.Stderr
+	}
+	interval := minCommitPollInterval
+	if opts.interval > 0 {
+		interval = opts.interval
+	}
+	// The number of network errors in a row.
+	var failures int
+	for {
+		latestBuild, err := getLatestBuild(ctx, client, org.Name, pipeline, branch)
 		if err != nil {
-			if isHttpError(err) {
-				fmt.Printf("Caught network error: %s. Continuing\n", err.Error())
-				lastPrintedAt = time.Now()
+			if buildkite.IsNetworkError(err) || buildkite.IsUnavailable(err) {
+				failures++
+				if opts.retryNetwork > 0 && failures > opts.retryNetwork {
+					return fmt.Errorf("giving up after %d network errors in a row: %w", failures, err)
+				}
+				fmt.Fprintf(progress, "Caught network error: %s. Continuing\n", err.Error())
 				select {
 				case <-ctx.Done():
-					return err
+					return ctx.Err()
 				case <-time.After(2 * time.Second):
 				}
 				continue
 			}
-			if err == errNoBuilds {
+			if err == buildkite.ErrNoBuilds {
 				//lint:ignore ST1005 this shows up in public facing error.
 				return fmt.Errorf("No results, are you sure there are tests for %s/%s?\n",
-					org.Name, remote.RepoName)
+					org.Name, pipeline)
 			}
 			return err
 		}
-		if latestBuild.Commit != tip {
-			fmt.Printf("Latest build in Buildkite is %s, waiting for %s...\n",
+		failures = 0
+		if !opts.latest && latestBuild.Commit != tip {
+			fmt.Fprintf(progress, "Latest build in Buildkite is %s, waiting for %s...\n",
 				latestBuild.Commit, tip)
-			lastPrintedAt = time.Now()
 			select {
 			case <-ctx.Done():
-				return err
-			case <-time.After(5 * time.Second):
+				return ctx.Err()
+			case <-time.After(interval):
 			}
+			interval = nextCommitPollInterval(interval)
 			continue
 		}
-		var duration time.Duration
-		if latestBuild.FinishedAt.Valid {
-			duration = latestBuild.FinishedAt.Time.Sub(latestBuild.StartedAt).Round(time.Second)
+		return showBuild(ctx, client, org.Name, pipeline, latestBuild, opts.buildOnly, opts.print)
+	}
+}
+
+// showBuild opens the page for build in a browser, or prints its URL if
+// printURL is set. See openBuildURL for which page is opened.
+func showBuild(ctx context.Context, client *buildkite.Client, org, pipeline string, build buildkite.Build, buildOnly, printURL bool) error {
+	if !buildOnly && (build.State == "failed" || build.State == "failing") {
+		// The build list doesn't always have complete job information, so
+		// fetch the build.
+		if full, err := getBuild(ctx, client, org, pipeline, build.Number); err == nil {
+			build = full
+		}
+	}
+	u := openBuildURL(build, buildOnly)
+	if printURL {
+		fmt.Println(u)
+		return nil
+	}
+	return browser.OpenURL(u)
+}
+
+// waitOptions configures the behavior of doWait.
+type waitOptions struct {
+	// Number of lines of failed output to display.
+	numOutputLines int
+	// If true, don't print progress or a summary of passing builds; only
+	// print output if the build fails.
+	quiet bool
+	// Whether to display a desktop notification when the build completes.
+	notify bool
+	// How long to wait between checks of the build state. Zero means the
+	// defaults: 3 seconds while the build runs, and 5 seconds while waiting
+	// for a build of the local commit to appear.
+	interval time.Duration
+	// If set, only show annotations with this context (e.g. "test-summary").
+	annotationContext string
+	// If set, only show annotations with this style (e.g. "error").
+	annotationStyle string
+	// If true, only show annotations with the error or warning style, for
+	// failed builds as well as passed ones.
+	onlyFailedAnnotations bool
+	// If true, show every annotation on a passing build, instead of only
+	// the error and warning ones.
+	includePassedAnnotations bool
+	// How to print annotations; one of the annotations* constants.
+	// annotationsNone skips fetching them.
+	annotationFormat string
+	// If true, after the build passes, wait for the builds started by its
+	// trigger steps, up to triggerDepth levels deep.
+	followTriggers bool
+	triggerDepth   int
+	// If the local commit isn't on any remote branch, give up after waiting
+	// this long for it to be pushed. Zero means wait forever.
+	unpushedTimeout time.Duration
+	// If true, wait for the latest build on the branch, whatever its commit,
+	// instead of a build of the local tip of the branch.
+	latest bool
+	// If set, wait for a build of this commit instead of the local tip of the
+	// branch.
+	commit string
+	// If set, wait for this build number, instead of looking up the build
+	// by branch and commit.
+	build int64
+	// How many network errors in a row to retry before giving up. Zero means
+	// retry forever.
+	retryNetwork int
+	// If true, open the build in a browser once it finishes, or print its
+	// URL if printURL is also set.
+	web      bool
+	printURL bool
+	// If true, unblock block steps when the build reaches them, instead of
+	// returning an error.
+	autoUnblock bool
+	// If true, stop waiting as soon as any job fails, instead of waiting for
+	// the rest of the build to finish.
+	failFast bool
+	// If true, list the earlier attempts of retried jobs in the summary, as
+	// well as the last one.
+	includeRetriedJobs bool
+	// If true, print progress as newline-delimited JSON events (see
+	// buildkite.WaitEvent) instead of text, and don't print a summary.
+	jsonStream bool
+	// How many recent builds to scan for a passing build, to estimate how
+	// long this one will take. Zero means maxBuildsToScan.
+	maxBuildsToScan int
+	// The clock to wait with; nil means buildkite.RealClock. Tests use a
+	// fake one so they don't have to sleep.
+	clock buildkite.Clock
+	// Where to print progress messages; nil means stdout.
+	progress io.Writer
+}
+
+func (o waitOptions) getClock() buildkite.Clock {
+	if o.clock != nil {
+		return o.clock
+	}
+	return buildkite.RealClock
+}
+
+func (o waitOptions) getMaxBuildsToScan() int {
+	if o.maxBuildsToScan > 0 {
+		return o.maxBuildsToScan
+	}
+	return maxBuildsToScan
+}
+
+func (o waitOptions) pollInterval() time.Duration {
+	if o.interval > 0 {
+		return o.interval
+	}
+	return 3 * time.Second
+}
+
+func (o waitOptions) commitInterval() time.Duration {
+	if o.interval > 0 {
+		return o.interval
+	}
+	return 5 * time.Second
+}
+
+// minPollInterval is the smallest -interval we allow, to avoid hammering the
+// Buildkite API.
+const minPollInterval = time.Second
+
+func validateInterval(interval time.Duration) error {
+	if interval != 0 && interval < minPollInterval {
+		return fmt.Errorf("-interval must be at least %s, got %s", minPollInterval, interval)
+	}
+	return nil
+}
+
+func doWait(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, opts waitOptions) (err error) {
+	// The commit to wait for; empty means the latest build on the branch.
+	// An empty branch means a build of tip on any branch.
+	var tip string
+	switch {
+	case opts.build > 0:
+		// We know which build to wait for, so we don't need the commit.
+	case opts.commit != "":
+		// Buildkite only matches full SHAs, so expand the commit if we have
+		// it locally.
+		var err error
+		tip, err = git.Tip(opts.commit)
+		if err != nil {
+			tip = opts.commit
+		}
+	case !opts.latest:
+		var err error
+		tip, err = git.Tip(branch)
+		if err != nil {
+			return err
+		}
+	}
+	// Progress messages go here, so they can be silenced with -quiet.
+	var status *statusLine
+	switch {
+	case opts.quiet, opts.jsonStream:
+		status = newStatusLine(io.Discard, false)
+	case opts.progress != nil:
+		status = newStatusLine(opts.progress, false)
+	default:
+		status = newStatusLine(os.Stdout, isatty())
+	}
+	clock := opts.getClock()
+	// With -json-stream, progress is written here instead of to status.
+	var events *json.Encoder
+	if opts.jsonStream {
+		if opts.progress != nil {
+			events = json.NewEncoder(opts.progress)
 		} else {
-			duration = time.Since(latestBuild.StartedAt).Round(time.Second)
-		}
-		c := bigtext.Client{
-			Name: "buildkite (" + remote.RepoName + ")",
-		}
-		switch latestBuild.State {
-		case "passed":
-			// TODO
-			var annotationANSI []string
-			annotations, err := getAnnotations(ctx, client, org.Name, remote.RepoName, latestBuild.Number)
-			if err == nil {
-				annotationANSI, _ = getANSIAnnotations(annotations)
+			events = json.NewEncoder(os.Stdout)
+		}
+	}
+	emit := func(event buildkite.WaitEvent) {
+		if events != nil {
+			events.Encode(event)
+		}
+	}
+	switch {
+	case opts.build > 0:
+		status.Printf("Waiting for build %d to complete\n", opts.build)
+	case branch == "":
+		status.Printf("Waiting for latest build of %s on any branch to complete\n", tip)
+	default:
+		status.Printf("Waiting for latest build on %s to complete\n", branch)
+	}
+	unpushed := tip != "" && warnIfUnpushed(tip)
+	start := clock.Now()
+	// Set if we give up waiting for an unpushed commit; see
+	// opts.unpushedTimeout.
+	var unpushedErr error
+	// Set if a job fails while the build is still running; see opts.failFast.
+	var failedEarly *buildkite.Build
+	// Canceled to stop waiting early. ctx stays usable, so we can still
+	// fetch the build's logs.
+	waitCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var latestBuild buildkite.Build
+	if opts.web && !opts.quiet {
+		// Open the build once we've printed the result, however it ends.
+		defer func() {
+			build := latestBuild
+			if failedEarly != nil {
+				build = *failedEarly
+			}
+			if build.Empty() {
+				return
+			}
+			if err := showBuild(ctx, client, org.Name, pipeline, build, false, opts.printURL); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not open build %d: %v\n", build.Number, err)
+			}
+		}()
+	}
+	if opts.jsonStream {
+		// Always finish with an event for the result, however we return.
+		defer func() {
+			build := latestBuild
+			if failedEarly != nil {
+				build = *failedEarly
+			}
+			event := buildkite.NewWaitEvent(build, clock.Now())
+			if build.Empty() {
+				event.Event = buildkite.EventError
+				event.Elapsed = clock.Now().Sub(start).Round(time.Second).Seconds()
+			} else if failedEarly == nil && !build.Done() && !build.Blocked() {
+				event.Event = buildkite.EventError
 			}
-			data := client.BuildSummary(ctx, org.Name, latestBuild, numOutputLines)
-			os.Stdout.Write(data)
-			output := fmt.Sprintf("\nTests on %s took %s. Quitting.\n", branch, duration.String())
-			if latestBuild.PullRequest != nil {
-				// No prefix for the URL so you can click and copy the whole
-				// line easily
-				output += latestBuild.PullRequest.URL() + "\n"
+			if err != nil {
+				event.Error = strings.TrimSpace(err.Error())
 			}
-			if len(annotationANSI) > 0 {
-				output += "\nAnnotations:\n"
-				for _, annotation := range annotationANSI {
-					output += annotation + "\n"
+			event.Final = true
+			emit(event)
+		}()
+	}
+	var lastPrintedAt time.Time
+	var previousBuild *buildkite.Build
+	if branch != "" {
+		previousBuild = scanPreviousBuilds(ctx, client, org.Name, pipeline, branch, previousBuildCount, opts.getMaxBuildsToScan())
+	}
+	// Description of the running jobs and an estimate of the time remaining,
+	// updated on the shouldPrint cadence.
+	var runningJobs, eta string
+	waitOpts := &buildkite.WaitOptions{
+		Interval:          opts.pollInterval(),
+		CommitInterval:    opts.commitInterval(),
+		Clock:             clock,
+		MaxNetworkRetries: opts.retryNetwork,
+		OnNetworkError: func(err error) {
+			emit(buildkite.WaitEvent{
+				Event:   buildkite.EventNetworkError,
+				Elapsed: clock.Now().Sub(start).Round(time.Second).Seconds(),
+				Error:   err.Error(),
+			})
+			status.Printf("Caught network error: %s. Continuing\n", err.Error())
+			lastPrintedAt = clock.Now()
+		},
+		OnWaitingForCommit: func(latestBuild buildkite.Build) {
+			if unpushed && opts.unpushedTimeout > 0 && clock.Now().Sub(start) > opts.unpushedTimeout {
+				if onRemote, ok := commitOnRemote(tip); ok && !onRemote {
+					//lint:ignore ST1005 this shows up in public facing error.
+					unpushedErr = fmt.Errorf("Commit %s still isn't on any remote branch after %s; push it and try again\n", tip, opts.unpushedTimeout)
+					cancel()
+					return
 				}
+				unpushed = false
 			}
-			fmt.Print(output)
-			c.Display(branch + " build complete!")
-			return nil
-		case "failing", "failed":
-			data := client.BuildSummary(ctx, org.Name, latestBuild, numOutputLines)
-			os.Stdout.Write(data)
-			/*
-				build, err := getBuild(client, latestBuild.ID)
-				if err == nil {
-					ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-					defer cancel()
-					stats, err := client.BuildSummary(ctx, build)
-					if err == nil {
-						fmt.Print(stats)
-					} else {
-						fmt.Printf("error fetching build stats: %v\n", err)
+			emit(buildkite.WaitEvent{
+				Event:   buildkite.EventWaitingForCommit,
+				Branch:  branch,
+				Commit:  tip,
+				Elapsed: clock.Now().Sub(start).Round(time.Second).Seconds(),
+			})
+			status.Printf("Latest build in Buildkite is %s, waiting for %s...\n",
+				latestBuild.Commit, tip)
+			lastPrintedAt = clock.Now()
+		},
+		OnProgress: func(latestBuild buildkite.Build) {
+			if opts.failFast && len(latestBuild.FailedJobs()) > 0 {
+				failedEarly = &latestBuild
+				cancel()
+				return
+			}
+			if opts.jsonStream {
+				emit(buildkite.NewWaitEvent(latestBuild, clock.Now()))
+				return
+			}
+			if latestBuild.State != "running" {
+				status.Printf("State is %s, trying again\n", latestBuild.State)
+				lastPrintedAt = clock.Now()
+				return
+			}
+			now := clock.Now()
+			duration := latestBuild.DurationAt(now).Round(time.Second)
+			// Show more and more output as we approach the duration of the previous
+			// successful build.
+			if shouldPrint(now, lastPrintedAt, duration, latestBuild, previousBuild) {
+				if !latestBuild.StartedAt.IsZero() {
+					// The build list doesn't always have complete job
+					// information, so fetch the build. This only happens
+					// when we print, so it doesn't add much load.
+					build, err := getBuild(ctx, client, org.Name, pipeline, latestBuild.Number)
+					if err != nil {
+						build = latestBuild
 					}
-				} else {
-					fmt.Printf("error getting build: %v\n", err)
+					runningJobs = runningJobsSummary(build)
+				}
+				eta = remainingEstimate(duration, previousBuild)
+				if !status.tty {
+					status.Update(withEstimate(runningStatus(latestBuild, duration, runningJobs), eta))
 				}
-			*/
-			fmt.Printf("\nURL:\n%s\n", latestBuild.WebURL)
+				lastPrintedAt = clock.Now()
+			}
+			// On a terminal, the status line is rewritten in place, so we can
+			// afford to update it on every poll.
+			if status.tty {
+				status.Update(withEstimate(runningStatus(latestBuild, duration, runningJobs), eta))
+			}
+		},
+	}
+	if opts.build > 0 {
+		latestBuild, err = client.Organization(org.Name).Pipeline(pipeline).Build(opts.build).Wait(waitCtx, waitOpts)
+	} else {
+		latestBuild, err = client.WaitForBuild(waitCtx, org.Name, pipeline, branch, tip, waitOpts)
+	}
+	for err == nil && latestBuild.Blocked() && opts.autoUnblock {
+		if err = unblockBuild(ctx, client, org.Name, pipeline, latestBuild, status); err != nil {
+			break
+		}
+		latestBuild, err = client.Organization(org.Name).Pipeline(pipeline).Build(latestBuild.Number).Wait(waitCtx, waitOpts)
+	}
+	status.Clear()
+	if unpushedErr != nil {
+		return unpushedErr
+	}
+	if failedEarly != nil {
+		if opts.jsonStream {
+			return failedEarlyError(*failedEarly)
+		}
+		if opts.includeRetriedJobs {
+			*failedEarly = withRetriedJobs(ctx, client, org.Name, pipeline, *failedEarly)
+		}
+		return failFast(ctx, client, org, pipeline, *failedEarly, opts)
+	}
+	if err != nil {
+		if rerr, ok := err.(*resterror.Error); ok && rerr.Status == http.StatusNotFound && opts.build > 0 {
 			//lint:ignore ST1005 this shows up in public facing error.
-			err = fmt.Errorf("Build on %s failed!\n\n", branch)
-			c.Display("build failed")
-			return err
-		case "running":
-			// Show more and more output as we approach the duration of the previous
-			// successful build.
-			if shouldPrint(lastPrintedAt, duration, latestBuild, previousBuild) {
-				fmt.Printf("Build %d running (%s elapsed)\n", latestBuild.Number, duration.String())
-				lastPrintedAt = time.Now()
+			return fmt.Errorf("Build %d not found in %s/%s\n", opts.build, org.Name, pipeline)
+		}
+		if err == buildkite.ErrNoBuilds && branch == "" {
+			//lint:ignore ST1005 this shows up in public facing error.
+			return fmt.Errorf("No builds of commit %s in %s/%s on any branch\n",
+				tip, org.Name, pipeline)
+		}
+		if err == buildkite.ErrNoBuilds {
+			//lint:ignore ST1005 this shows up in public facing error.
+			return fmt.Errorf("No results, are you sure there are tests for %s/%s?\n",
+				org.Name, pipeline)
+		}
+		return err
+	}
+	if opts.build > 0 {
+		branch = latestBuild.Branch
+	} else if branch == "" {
+		branch = latestBuild.Branch
+		status.Printf("Found build %d of %s on %s\n", latestBuild.Number, tip, branch)
+	}
+	if opts.jsonStream {
+		// The final event reports the result, so don't print a summary.
+		if latestBuild.State == "passed" {
+			return nil
+		}
+		//lint:ignore ST1005 this shows up in public facing error.
+		return fmt.Errorf("Build on %s finished with state %q\n\n", branch, latestBuild.State)
+	}
+	if opts.includeRetriedJobs {
+		latestBuild = withRetriedJobs(ctx, client, org.Name, pipeline, latestBuild)
+	}
+	duration := latestBuild.DurationAt(clock.Now()).Round(time.Second)
+	c := newNotifier("buildkite ("+pipeline+")", opts.notify && !opts.quiet)
+	switch latestBuild.State {
+	case "passed":
+		if opts.followTriggers {
+			status.Printf("Build %d passed, waiting for the builds it triggered\n", latestBuild.Number)
+			if err := followTriggers(ctx, client, org.Name, pipeline, latestBuild, opts.triggerDepth, opts, status); err != nil {
+				notify(c, "triggered build failed")
+				return err
 			}
-		default:
-			/*
-				if latestBuild.State == "failing" {
-					fmt.Printf("latest build: %#v\n", latestBuild)
-				}
-			*/
-			fmt.Printf("State is %s, trying again\n", latestBuild.State)
-			lastPrintedAt = time.Now()
 		}
-		select {
-		case <-time.After(3 * time.Second):
-		case <-ctx.Done():
-			return ctx.Err()
+		if opts.quiet {
+			return nil
 		}
-		_ = previousBuild
+		annotations := buildAnnotations(ctx, client, org.Name, pipeline, latestBuild, opts, passedBuildAnnotations)
+		data := client.BuildSummary(ctx, org.Name, pipeline, latestBuild, opts.numOutputLines)
+		os.Stdout.Write(data)
+		output := fmt.Sprintf("\nTests on %s took %s%s. Quitting.\n", branch, duration.String(), buildOrigin(latestBuild))
+		if latestBuild.PullRequest != nil {
+			// No prefix for the URL so you can click and copy the whole
+			// line easily
+			output += latestBuild.PullRequest.ProviderURL(org.GitProvider) + "\n"
+		} else if u := pullRequestSearchURL(latestBuild); u != "" {
+			// Buildkite often doesn't record the pull request for a
+			// build, so link to a search for it instead.
+			output += u + "\n"
+		}
+		output += annotations
+		fmt.Print(output)
+		notify(c, branch+" build complete!")
+		return nil
+	case "blocked":
+		printBlocked(ctx, client, org.Name, pipeline, branch, latestBuild)
+		notify(c, "build blocked")
+		//lint:ignore ST1005 this shows up in public facing error.
+		return fmt.Errorf("Build on %s is blocked; unblock it in Buildkite, or wait with -auto-unblock\n\n", branch)
+	case "failing", "failed":
+		data := client.BuildSummary(ctx, org.Name, pipeline, latestBuild, opts.numOutputLines)
+		os.Stdout.Write(data)
+		fmt.Printf("\nURL:\n%s\n", latestBuild.WebURL)
+		fmt.Print(buildAnnotations(ctx, client, org.Name, pipeline, latestBuild, opts, failedBuildAnnotations))
+		//lint:ignore ST1005 this shows up in public facing error.
+		err = fmt.Errorf("Build on %s failed!%s\n\n", branch, buildOrigin(latestBuild))
+		notify(c, "build failed")
+		return err
+	default:
+		fmt.Printf("\nURL:\n%s\n", latestBuild.WebURL)
+		//lint:ignore ST1005 this shows up in public facing error.
+		err = fmt.Errorf("Build on %s finished with state %q\n\n", branch, latestBuild.State)
+		notify(c, "build "+string(latestBuild.State))
+		return err
 	}
-	/*
-		fmt.Println("tip", tip)
-		fmt.Println("builds err", err)
-		fmt.Println("builds", builds)
-	*/
-	_ = lastPrintedAt
-	return nil
 }
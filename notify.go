@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+	"runtime"
+
+	"github.com/kevinburke/bigtext"
+)
+
+// A notifier displays a desktop notification, for example when a build
+// completes. bigtext.Client is a notifier.
+type notifier interface {
+	Display(text string) error
+}
+
+// notifySend displays notifications on Linux desktops with notify-send.
+type notifySend struct {
+	Name string
+}
+
+func (n notifySend) Display(text string) error {
+	return exec.Command("notify-send", n.Name, text).Run()
+}
+
+// noopNotifier is used when notifications are disabled or there is no way to
+// display them on this platform.
+type noopNotifier struct{}
+
+func (noopNotifier) Display(string) error { return nil }
+
+// newNotifier returns a notifier that displays notifications from name. If
+// enabled is false, or this platform has no supported notifier, the returned
+// notifier does nothing.
+func newNotifier(name string, enabled bool) notifier {
+	if !enabled {
+		return noopNotifier{}
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return &bigtext.Client{Name: name}
+	case "linux", "freebsd", "openbsd", "netbsd":
+		if _, err := exec.LookPath("notify-send"); err == nil {
+			return notifySend{Name: name}
+		}
+	}
+	slog.Debug("no desktop notifier available", "os", runtime.GOOS)
+	return noopNotifier{}
+}
+
+// notify displays text using n, logging any error instead of returning it -
+// a missing notification isn't worth failing the command over.
+func notify(n notifier, text string) {
+	if err := n.Display(text); err != nil {
+		slog.Debug("could not display notification", "error", err)
+	}
+}
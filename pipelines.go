@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// pipelinesPerPage is the largest page size the Buildkite API allows.
+const pipelinesPerPage = 100
+
+// forEachPipelinePage calls fn with each page of the pipelines in org, so
+// callers don't need to hold every pipeline in memory at once.
+func forEachPipelinePage(ctx context.Context, client *buildkite.Client, org string, fn func([]buildkite.Pipeline) error) error {
+	for page := 1; ; page++ {
+		reqCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		resp, err := client.Organization(org).ListPipelines(reqCtx, url.Values{
+			"page":     []string{strconv.Itoa(page)},
+			"per_page": []string{strconv.Itoa(pipelinesPerPage)},
+		})
+		cancel()
+		if err != nil {
+			return err
+		}
+		if err := fn(resp); err != nil {
+			return err
+		}
+		if len(resp) < pipelinesPerPage {
+			return nil
+		}
+	}
+}
+
+// jsonArrayWriter writes values to w as the elements of a JSON array, one per
+// line, without having to collect them first.
+type jsonArrayWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (j *jsonArrayWriter) Write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if j.count == 0 {
+		sep = "[\n  "
+	}
+	j.count++
+	_, err = fmt.Fprintf(j.w, "%s%s", sep, data)
+	return err
+}
+
+// Close ends the array. It must be called even if no values were written.
+func (j *jsonArrayWriter) Close() error {
+	if j.count == 0 {
+		_, err := io.WriteString(j.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(j.w, "\n]\n")
+	return err
+}
+
+// matchesPipelineFilter reports whether filter is a (case insensitive)
+// substring of the pipeline's slug, name or repository.
+func matchesPipelineFilter(p buildkite.Pipeline, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	filter = strings.ToLower(filter)
+	return strings.Contains(strings.ToLower(p.Slug), filter) ||
+		strings.Contains(strings.ToLower(p.Name), filter) ||
+		strings.Contains(strings.ToLower(p.Repository), filter)
+}
+
+func doPipelines(ctx context.Context, client *buildkite.Client, org buildkite.Organization, filter string, asJSON bool) error {
+	if asJSON {
+		// Print each page as it arrives, since large orgs can have thousands
+		// of pipelines.
+		arr := &jsonArrayWriter{w: os.Stdout}
+		err := forEachPipelinePage(ctx, client, org.Name, func(pipelines []buildkite.Pipeline) error {
+			for _, p := range pipelines {
+				if !matchesPipelineFilter(p, filter) {
+					continue
+				}
+				if err := arr.Write(p); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return arr.Close()
+	}
+	// The table needs every row to line up the columns, so this holds all of
+	// the pipelines in memory.
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "SLUG\tNAME\tREPOSITORY\tRUNNING\tSCHEDULED\n")
+	err := forEachPipelinePage(ctx, client, org.Name, func(pipelines []buildkite.Pipeline) error {
+		for _, p := range pipelines {
+			if !matchesPipelineFilter(p, filter) {
+				continue
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\n", p.Slug, p.Name, p.Repository, p.RunningBuildsCount, p.ScheduledBuildsCount)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
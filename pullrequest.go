@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+	git "github.com/kevinburke/go-git"
+)
+
+// pullRequestSearchURL returns a link to the open pull requests for the
+// build's branch, for builds where Buildkite didn't record a pull request.
+// It returns the empty string if the build is on the pipeline's default
+// branch, or if the repository isn't hosted on GitHub or GitLab.
+func pullRequestSearchURL(build buildkite.Build) string {
+	if build.Branch == "" || build.Pipeline.Repository == "" {
+		return ""
+	}
+	defaultBranch := build.Pipeline.DefaultBranch
+	if build.Branch == defaultBranch || (defaultBranch == "" && (build.Branch == "main" || build.Branch == "master")) {
+		return ""
+	}
+	remote, err := git.ParseRemoteURL(build.Pipeline.Repository)
+	if err != nil {
+		return ""
+	}
+	repo := strings.TrimSuffix(remote.RepoName, ".git")
+	switch remote.Host {
+	case "github.com":
+		q := url.Values{"q": []string{"is:pr is:open head:" + build.Branch}}
+		return "https://github.com/" + remote.Path + "/" + repo + "/pulls?" + q.Encode()
+	case "gitlab.com":
+		q := url.Values{"state": []string{"opened"}, "source_branch": []string{build.Branch}}
+		return "https://gitlab.com/" + remote.Path + "/" + repo + "/-/merge_requests?" + q.Encode()
+	default:
+		return ""
+	}
+}
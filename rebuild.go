@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+	"github.com/kevinburke/rest/resterror"
+)
+
+// doRebuild starts a new build with the same commit, branch and environment
+// as build number, and prints the new build's number and URL to w, or the
+// build as JSON if asJSON is set.
+func doRebuild(ctx context.Context, w io.Writer, client *buildkite.Client, org buildkite.Organization, pipeline string, number int64, asJSON bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	build, err := client.Organization(org.Name).Pipeline(pipeline).Build(number).Rebuild(ctx)
+	if rerr, ok := err.(*resterror.Error); ok {
+		switch rerr.Status {
+		case http.StatusNotFound:
+			//lint:ignore ST1005 this shows up in public facing error.
+			return fmt.Errorf("Build %d not found in %s/%s\n", number, org.Name, pipeline)
+		case http.StatusUnprocessableEntity:
+			// Buildkite refuses to rebuild builds that are too old, among
+			// other things.
+			//lint:ignore ST1005 this shows up in public facing error.
+			return fmt.Errorf("Can't rebuild build %d: %s\nUse \"buildkite create\" to start a new build on the branch instead\n", number, rerr.Title)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return writeBuildResult(w, build)
+	}
+	fmt.Fprintf(w, "Started build %d, a rebuild of build %d on %s\n", build.Number, number, build.Branch)
+	fmt.Fprintln(w, build.WebURL)
+	return nil
+}
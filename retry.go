@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// emojiRe matches Buildkite emoji shortcodes like ":golang:".
+var emojiRe = regexp.MustCompile(`:[a-z0-9_+-]+:`)
+
+// normalizeJobName strips emoji shortcodes and surrounding whitespace from a
+// job name, and lowercases it, so "go test" matches ":golang: Go Test".
+func normalizeJobName(name string) string {
+	return strings.ToLower(strings.TrimSpace(emojiRe.ReplaceAllString(name, "")))
+}
+
+// findJobsByName returns the jobs whose names contain name, ignoring case and
+// emoji. If any job's name matches name exactly, only the exact matches are
+// returned; there can be more than one, e.g. for parallel jobs or matrix
+// steps.
+func findJobsByName(jobs []buildkite.Job, name string) []buildkite.Job {
+	want := normalizeJobName(name)
+	var exact, matches []buildkite.Job
+	for _, job := range jobs {
+		if job.Type == "waiter" {
+			continue
+		}
+		got := normalizeJobName(job.Name)
+		if got == want {
+			exact = append(exact, job)
+		}
+		if strings.Contains(got, want) {
+			matches = append(matches, job)
+		}
+	}
+	if len(exact) > 0 {
+		return exact
+	}
+	return matches
+}
+
+// errEmptyJobName is returned by findJob for a name that is empty once
+// whitespace and emoji are removed, since it would match every job.
+var errEmptyJobName = errors.New("-job needs the name of a job")
+
+// findJob returns the single job in build matching name, or an error listing
+// the candidates if there is not exactly one.
+func findJob(build buildkite.Build, name string) (buildkite.Job, error) {
+	if normalizeJobName(name) == "" {
+		return buildkite.Job{}, errEmptyJobName
+	}
+	matches := findJobsByName(build.Jobs, name)
+	switch len(matches) {
+	case 0:
+		return buildkite.Job{}, fmt.Errorf("no job in build %d matches %q", build.Number, name)
+	case 1:
+		return matches[0], nil
+	default:
+		names := make([]string, len(matches))
+		for i := range matches {
+			// Parallel jobs share a name, so show the ID too.
+			names[i] = fmt.Sprintf("\t%s (job %s)", matches[i].Name, matches[i].ID)
+		}
+		return buildkite.Job{}, fmt.Errorf("%q matches more than one job in build %d:\n\n%s\n\nUse a more specific name",
+			name, build.Number, strings.Join(names, "\n"))
+	}
+}
+
+func doRetry(ctx context.Context, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, jobName string) error {
+	latestBuild, err := getLatestBuild(ctx, client, org.Name, pipeline, branch)
+	if err != nil {
+		if err == buildkite.ErrNoBuilds {
+			//lint:ignore ST1005 this shows up in public facing error.
+			return fmt.Errorf("No results, are you sure there are tests for %s/%s?\n",
+				org.Name, pipeline)
+		}
+		return err
+	}
+	build, err := getBuild(ctx, client, org.Name, pipeline, latestBuild.Number)
+	if err != nil {
+		return err
+	}
+	job, err := findJob(build, jobName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	newJob, err := client.Organization(org.Name).Pipeline(pipeline).Build(build.Number).Job(job.ID).Retry(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Retrying %q in build %d\n", job.Name, build.Number)
+	fmt.Println(newJob.WebURL(build.WebURL))
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// statusLine prints progress messages. When writing to a terminal, Update
+// overwrites the previous status line in place, instead of printing a new
+// line each time.
+type statusLine struct {
+	w   io.Writer
+	tty bool
+	// whether a status line is currently displayed and needs to be cleared
+	// before printing anything else.
+	active bool
+	frame  int
+}
+
+func newStatusLine(w io.Writer, tty bool) *statusLine {
+	return &statusLine{w: w, tty: tty}
+}
+
+// Update displays msg as the current status. On a terminal, msg replaces the
+// previous status and is prefixed with a spinner; otherwise it's printed on
+// its own line.
+func (s *statusLine) Update(msg string) {
+	if !s.tty {
+		fmt.Fprintln(s.w, msg)
+		return
+	}
+	fmt.Fprintf(s.w, "\r\033[K%s %s", spinnerFrames[s.frame%len(spinnerFrames)], msg)
+	s.frame++
+	s.active = true
+}
+
+// Clear removes the status line, if one is displayed, so the next output
+// starts at the beginning of an empty line.
+func (s *statusLine) Clear() {
+	if s.active {
+		fmt.Fprint(s.w, "\r\033[K")
+		s.active = false
+	}
+}
+
+// Printf clears the status line and prints a message that should stay on the
+// screen.
+func (s *statusLine) Printf(format string, args ...interface{}) {
+	s.Clear()
+	fmt.Fprintf(s.w, format, args...)
+}
+
+// jobProgress returns the number of jobs in build that have finished, and the
+// total number of jobs, ignoring "waiter" jobs.
+func jobProgress(build buildkite.Build) (finished int, total int) {
+	for _, job := range build.Jobs {
+		if job.Type == "waiter" {
+			continue
+		}
+		total++
+		if job.FinishedAt.Valid {
+			finished++
+		}
+	}
+	return finished, total
+}
+
+// runningStatus describes the progress of a running build. running is a
+// description of the running jobs, see runningJobsSummary.
+func runningStatus(build buildkite.Build, elapsed time.Duration, running string) string {
+	if build.StartedAt.IsZero() {
+		// No agent has picked up the build yet, so there's no elapsed time
+		// to report.
+		return fmt.Sprintf("Build %d queued, waiting for an agent", build.Number)
+	}
+	msg := fmt.Sprintf("Build %d running (%s elapsed", build.Number, elapsed.String())
+	if finished, total := jobProgress(build); total > 0 {
+		msg += fmt.Sprintf(", %d/%d jobs finished", finished, total)
+	}
+	if running != "" {
+		msg += ", running " + running
+	}
+	return msg + ")"
+}
+
+// Exit codes for the status command.
+const (
+	statusPassed  = 0
+	statusFailed  = 1
+	statusRunning = 2
+)
+
+// statusExitCode returns the exit code for the status command: 0 if build
+// passed, 2 if it hasn't finished (or 0 with exitZeroOnRunning), and 1
+// otherwise.
+func statusExitCode(build buildkite.Build, exitZeroOnRunning bool) int {
+	switch {
+	case build.State == "passed":
+		return statusPassed
+	case build.State == "failing":
+		// Some jobs are still running, but the build can't pass.
+		return statusFailed
+	case !build.Done():
+		if exitZeroOnRunning {
+			return statusPassed
+		}
+		return statusRunning
+	default:
+		return statusFailed
+	}
+}
+
+// doStatus prints the state of the latest build on branch to w and returns the
+// build. If format is not nil, the build is printed with it instead, like
+// "list" does; the "json" preset prints it with writeBuildResult.
+func doStatus(ctx context.Context, w io.Writer, client *buildkite.Client, org buildkite.Organization, pipeline string, branch string, format *buildFormatter) (buildkite.Build, error) {
+	build, err := getLatestBuild(ctx, client, org.Name, pipeline, branch)
+	if err != nil {
+		if err == buildkite.ErrNoBuilds {
+			//lint:ignore ST1005 this shows up in public facing error.
+			return buildkite.Build{}, fmt.Errorf("No results, are you sure there are tests for %s/%s?\n",
+				org.Name, pipeline)
+		}
+		return buildkite.Build{}, err
+	}
+	switch {
+	case format != nil && format.json:
+		return build, writeBuildResult(w, build)
+	case format != nil:
+		return build, format.Write(w, []buildkite.Build{build})
+	}
+	duration := build.Duration().Round(time.Second)
+	if build.Done() {
+		fmt.Fprintf(w, "Build %d on %s %s in %s\n", build.Number, branch, build.State, duration)
+	} else {
+		fmt.Fprintf(w, "%s on %s\n", runningStatus(build, duration, ""), branch)
+	}
+	fmt.Fprintln(w, build.WebURL)
+	return build, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+	git "github.com/kevinburke/go-git"
+)
+
+// targetFlags holds the flags that determine which Buildkite org and pipeline
+// a command operates on.
+type targetFlags struct {
+	remote   *string
+	org      *string
+	pipeline *string
+}
+
+// addOrgFlags adds the -remote and -org flags to fs, for commands that
+// operate on a whole organization.
+func addOrgFlags(fs *flag.FlagSet) targetFlags {
+	return targetFlags{
+		remote: fs.String("remote", "origin", "Git remote to use"),
+		org:    fs.String("org", "", "Buildkite org to use, instead of detecting it from the git remote"),
+	}
+}
+
+// addTargetFlags adds the -remote, -org and -pipeline flags to fs, for
+// commands that operate on a single pipeline.
+func addTargetFlags(fs *flag.FlagSet) targetFlags {
+	t := addOrgFlags(fs)
+	t.pipeline = fs.String("pipeline", "", "Buildkite pipeline slug to use, instead of detecting it from the git remote")
+	return t
+}
+
+// resolveOrg returns a client and the Buildkite organization to use for a
+// command. By default the org is derived from the git remote, but the -org
+// flag overrides that detection, in which case the returned remote is nil.
+func resolveOrg(cfg *buildkite.FileConfig, t targetFlags) (*buildkite.Client, buildkite.Organization, *git.RemoteURL, error) {
+	if *t.org != "" {
+		org, ok := cfg.Org(*t.org)
+		if !ok {
+			return nil, buildkite.Organization{}, nil, fmt.Errorf("could not find org %q in the config", *t.org)
+		}
+		token, err := org.APIToken()
+		if err != nil {
+			return nil, buildkite.Organization{}, nil, err
+		}
+		client, err := newClient(org, token)
+		return client, org, nil, err
+	}
+	remote, org, err := resolveRemote(cfg, *t.remote)
+	if err != nil {
+		return nil, buildkite.Organization{}, nil, err
+	}
+	token, err := cfg.Token(remote.Path)
+	if err != nil {
+		return nil, buildkite.Organization{}, nil, err
+	}
+	client, err := newClient(org, token)
+	return client, org, remote, err
+}
+
+// resolveOrgForPipeline returns a client and the Buildkite organization to
+// use for pipeline, for commands that don't look at the git checkout. The
+// -org flag (orgName) wins, then the org that the [pipelines] section of the
+// config maps pipeline to, then the default org.
+func resolveOrgForPipeline(cfg *buildkite.FileConfig, orgName, pipeline string) (*buildkite.Client, buildkite.Organization, error) {
+	var org buildkite.Organization
+	var ok bool
+	if orgName != "" {
+		org, ok = cfg.Org(orgName)
+		if !ok {
+			return nil, buildkite.Organization{}, fmt.Errorf("could not find org %q in the config", orgName)
+		}
+	} else {
+		org, ok = cfg.OrgForPipeline(pipeline)
+		if !ok && cfg.Default != "" {
+			org, ok = cfg.Org(cfg.Default)
+		}
+		if !ok {
+			return nil, buildkite.Organization{}, fmt.Errorf("could not find an org for pipeline %q in the config; pass -org", pipeline)
+		}
+	}
+	token, err := org.APIToken()
+	if err != nil {
+		return nil, buildkite.Organization{}, err
+	}
+	client, err := newClient(org, token)
+	return client, org, err
+}
+
+// newClient returns a client that authenticates with token, through org's
+// proxy if it has one. If org gets its token from a token_command, the
+// command is run again to refresh the token if it's rejected.
+func newClient(org buildkite.Organization, token string) (*buildkite.Client, error) {
+	var hc *http.Client
+	if org.Proxy != "" {
+		var err error
+		hc, err = buildkite.NewProxyHTTPClient(org.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("organization %s: %w", org.Name, err)
+		}
+	}
+	client := buildkite.NewClientWithHTTPClient(token, hc)
+	if org.TokenCommand != "" {
+		client.RefreshToken = org.APIToken
+	}
+	return client, nil
+}
+
+// resolveTarget returns a client, the Buildkite organization and the pipeline
+// slug to use for a command. By default these are derived from the git
+// remote, but the -org and -pipeline flags override that detection.
+func resolveTarget(cfg *buildkite.FileConfig, t targetFlags) (*buildkite.Client, buildkite.Organization, string, error) {
+	client, org, remote, err := resolveOrg(cfg, t)
+	if err != nil {
+		return nil, buildkite.Organization{}, "", err
+	}
+	if *t.pipeline != "" {
+		return client, org, *t.pipeline, nil
+	}
+	if remote == nil {
+		remote, err = git.GetRemoteURL(*t.remote)
+		if err != nil {
+			return nil, buildkite.Organization{}, "", err
+		}
+	}
+	if slug, ok := configuredPipeline(cfg, remote); ok {
+		return client, org, slug, nil
+	}
+	return client, org, remote.RepoName, nil
+}
+
+// configuredPipeline looks up the pipeline slug for the current repository in
+// the [pipelines] section of the config, by the repository's root directory
+// or by its git remote. In a linked worktree, the root of the main checkout
+// is checked too, so one entry covers every worktree.
+func configuredPipeline(cfg *buildkite.FileConfig, remote *git.RemoteURL) (string, bool) {
+	root, _ := repoRoot("")
+	mainRoot, _ := mainWorktreeRoot("")
+	repo := remote.Path + "/" + remote.RepoName
+	return cfg.PipelineFor(root, mainRoot, remote.Host+"/"+repo, repo)
+}
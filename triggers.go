@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// defaultTriggerDepth is how many levels of triggered builds wait follows by
+// default: the builds triggered by the build we're waiting on, and the builds
+// that those trigger in turn.
+const defaultTriggerDepth = 2
+
+// followTriggers waits for each build triggered by build, and, up to depth
+// levels deep, the builds those trigger in turn. It returns an error naming
+// every triggered build that didn't pass.
+func followTriggers(ctx context.Context, client *buildkite.Client, org, pipeline string, build buildkite.Build, depth int, opts waitOptions, status *statusLine) error {
+	failed, err := waitForTriggers(ctx, client, org, pipeline, build, depth, opts, status)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		//lint:ignore ST1005 this shows up in public facing error.
+		return fmt.Errorf("Triggered builds did not pass: %s\n\n", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// waitForTriggers does the work for followTriggers, returning a description
+// of each triggered build that failed.
+func waitForTriggers(ctx context.Context, client *buildkite.Client, org, pipeline string, build buildkite.Build, depth int, opts waitOptions, status *statusLine) ([]string, error) {
+	if depth <= 0 {
+		return nil, nil
+	}
+	// The build list doesn't always include the triggered_build for each
+	// job, so fetch the build.
+	full, err := getBuild(ctx, client, org, pipeline, build.Number)
+	if err != nil {
+		return nil, err
+	}
+	var failed []string
+	for _, triggered := range full.TriggeredBuilds() {
+		triggeredOrg, slug, ok := triggered.Pipeline()
+		if !ok {
+			slog.Debug("could not find pipeline for triggered build", "url", triggered.URL, "web_url", triggered.WebURL)
+			continue
+		}
+		status.Printf("Waiting for triggered build %s #%d\n", slug, triggered.Number)
+		var lastPrintedAt time.Time
+		child, err := client.Organization(triggeredOrg).Pipeline(slug).Build(triggered.Number).Wait(ctx, &buildkite.WaitOptions{
+			Interval:          opts.pollInterval(),
+			MaxNetworkRetries: opts.retryNetwork,
+			OnNetworkError: func(err error) {
+				status.Printf("Caught network error: %s. Continuing\n", err.Error())
+			},
+			OnProgress: func(child buildkite.Build) {
+				// Off a terminal, each update is a new line, so don't
+				// print one on every poll.
+				if !status.tty && time.Since(lastPrintedAt) < heartbeatInterval {
+					return
+				}
+				msg := runningStatus(child, child.Duration().Round(time.Second), runningJobsSummary(child))
+				status.Update(slug + ": " + msg)
+				lastPrintedAt = time.Now()
+			},
+		})
+		status.Clear()
+		if err != nil {
+			return nil, err
+		}
+		if child.State != "passed" {
+			data := client.BuildSummary(ctx, triggeredOrg, slug, child, opts.numOutputLines)
+			os.Stdout.Write(data)
+			fmt.Printf("\nURL:\n%s\n", child.WebURL)
+			failed = append(failed, fmt.Sprintf("%s #%d (%s)", slug, child.Number, child.State))
+			continue
+		}
+		status.Printf("Triggered build %s #%d passed in %s\n", slug, child.Number, child.Duration().Round(time.Second))
+		childFailed, err := waitForTriggers(ctx, client, triggeredOrg, slug, child, depth-1, opts, status)
+		if err != nil {
+			return nil, err
+		}
+		failed = append(failed, childFailed...)
+	}
+	return failed, nil
+}
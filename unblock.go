@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// blockLabel returns the label of a block step, falling back to its name.
+func blockLabel(job buildkite.Job) string {
+	if job.Label != "" {
+		return job.Label
+	}
+	return job.Name
+}
+
+// blockedJobs returns the block steps that build is waiting on. The build
+// list doesn't always include every job, so this fetches the build.
+func blockedJobs(ctx context.Context, client *buildkite.Client, org, pipeline string, build buildkite.Build) ([]buildkite.Job, error) {
+	full, err := getBuild(ctx, client, org, pipeline, build.Number)
+	if err != nil {
+		return nil, err
+	}
+	return full.BlockedJobs(), nil
+}
+
+// unblockBuild unblocks each block step that build is waiting on, so the rest
+// of the build can run.
+func unblockBuild(ctx context.Context, client *buildkite.Client, org, pipeline string, build buildkite.Build, status *statusLine) error {
+	jobs, err := blockedJobs(ctx, client, org, pipeline, build)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		return fmt.Errorf("build %d is blocked, but none of its steps are waiting to be unblocked", build.Number)
+	}
+	for _, job := range jobs {
+		if !job.Unblockable {
+			return fmt.Errorf("your API token can't unblock %q in build %d", blockLabel(job), build.Number)
+		}
+		unblockCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		_, err := client.Organization(org).Pipeline(pipeline).Build(build.Number).Job(job.ID).Unblock(unblockCtx)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("unblocking %q in build %d: %w", blockLabel(job), build.Number, err)
+		}
+		status.Printf("Unblocked %q in build %d\n", blockLabel(job), build.Number)
+	}
+	return nil
+}
+
+// printBlocked prints the block steps that build is waiting on, with a link
+// to each one.
+func printBlocked(ctx context.Context, client *buildkite.Client, org, pipeline, branch string, build buildkite.Build) {
+	fmt.Printf("\nBuild %d on %s is waiting for someone to unblock it:\n", build.Number, branch)
+	jobs, err := blockedJobs(ctx, client, org, pipeline, build)
+	if err != nil || len(jobs) == 0 {
+		fmt.Println(build.WebURL)
+		return
+	}
+	for _, job := range jobs {
+		fmt.Printf("\t%s: %s\n", blockLabel(job), job.WebURL(build.WebURL))
+	}
+}
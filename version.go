@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+)
+
+// tagsURL lists the git tags for the project. Releases are tagged like
+// "v0.16"; see "make release".
+const tagsURL = "https://api.github.com/repos/kevinburke/buildkite/tags?per_page=100"
+
+const releasesURL = "https://github.com/kevinburke/buildkite/tags"
+
+// versionCheckInterval is how long to reuse the result of a version check
+// before asking GitHub again.
+const versionCheckInterval = 24 * time.Hour
+
+// versionCache is saved to disk, so "version -check" doesn't make a request
+// every time it's run.
+type versionCache struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Latest    string    `json:"latest"`
+}
+
+// versionCachePath returns the file the latest version is cached in.
+func versionCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "buildkite", "latest-version.json"), nil
+}
+
+// compareVersions compares two versions like "0.16" or "v1.2.3" number by
+// number, returning -1, 0 or 1. Missing numbers count as 0, and anything
+// that isn't a number sorts first.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var an, bn int
+		if i < len(as) {
+			an, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			bn, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+	}
+	return 0
+}
+
+// fetchLatestVersion returns the highest version tagged at url.
+func fetchLatestVersion(ctx context.Context, client *http.Client, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("bad status from %s: %s", url, resp.Status)
+	}
+	var tags []struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return "", err
+	}
+	var latest string
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag.Name, "v") {
+			continue
+		}
+		if latest == "" || compareVersions(tag.Name, latest) > 0 {
+			latest = tag.Name
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("no version tags found at %s", url)
+	}
+	return latest, nil
+}
+
+// latestVersion returns the latest released version, from the cache at
+// cachePath if it was checked in the last day, or else from url. If cachePath
+// is empty, the cache isn't used.
+func latestVersion(ctx context.Context, client *http.Client, url, cachePath string, now time.Time) (string, error) {
+	if cachePath != "" {
+		if data, err := os.ReadFile(cachePath); err == nil {
+			var cache versionCache
+			if json.Unmarshal(data, &cache) == nil && cache.Latest != "" && now.Sub(cache.CheckedAt) < versionCheckInterval {
+				return cache.Latest, nil
+			}
+		}
+	}
+	latest, err := fetchLatestVersion(ctx, client, url)
+	if err != nil {
+		return "", err
+	}
+	if cachePath != "" {
+		data, _ := json.Marshal(versionCache{CheckedAt: now, Latest: latest})
+		if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err == nil {
+			if err := os.WriteFile(cachePath, data, 0o644); err != nil {
+				slog.Debug("could not cache latest version", "error", err)
+			}
+		}
+	}
+	return latest, nil
+}
+
+// doVersion prints the current version, and with check, whether there is a
+// newer one. Errors checking are only logged, since the version check is
+// best effort.
+func doVersion(ctx context.Context, check bool) {
+	fmt.Fprintf(os.Stdout, "buildkite version %s\n", buildkite.Version)
+	if !check {
+		return
+	}
+	cachePath, err := versionCachePath()
+	if err != nil {
+		slog.Debug("could not find cache directory", "error", err)
+		cachePath = ""
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	latest, err := latestVersion(ctx, http.DefaultClient, tagsURL, cachePath, time.Now())
+	if err != nil {
+		slog.Debug("could not check for a newer version", "error", err)
+		return
+	}
+	if compareVersions(latest, buildkite.Version) > 0 {
+		fmt.Printf("A newer version, %s, is available: %s\n", latest, releasesURL)
+	} else {
+		fmt.Println("This is the latest version.")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	buildkite "github.com/kevinburke/buildkite/lib"
+	"github.com/kevinburke/rest/resterror"
+)
+
+// isUnauthorized reports whether err is a 401 from the Buildkite API.
+func isUnauthorized(err error) bool {
+	var rerr *resterror.Error
+	return errors.As(err, &rerr) && rerr.Status == http.StatusUnauthorized
+}
+
+func doWhoami(ctx context.Context, client *buildkite.Client, org buildkite.Organization) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	user, err := client.CurrentUser(ctx)
+	if err != nil {
+		if isUnauthorized(err) {
+			//lint:ignore ST1005 this shows up in public facing error.
+			return fmt.Errorf("The API token for %s is invalid or expired.\n\nGo to https://buildkite.com/user/api-access-tokens to create a new one.\n", org.Name)
+		}
+		return err
+	}
+	orgs, err := client.ListOrganizations(ctx, nil)
+	if err != nil {
+		return err
+	}
+	slugs := make([]string, len(orgs))
+	for i := range orgs {
+		slugs[i] = orgs[i].Slug
+	}
+	fmt.Printf("Name:          %s\n", user.Name)
+	fmt.Printf("Email:         %s\n", user.Email)
+	fmt.Printf("Token from:    %s\n", org.Name)
+	fmt.Printf("Organizations: %s\n", strings.Join(slugs, ", "))
+	return nil
+}